@@ -0,0 +1,371 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"gopkg.in/yaml.v2"
+)
+
+// Collectors which can be enabled per module.
+const (
+	collectorStats       = "stats"
+	collectorSettings    = "settings"
+	collectorDerived     = "derived"
+	collectorPassthrough = "passthrough"
+)
+
+// Config is the configuration file of the exporter.
+type Config struct {
+	// Modules are selected by the module parameter of /probe. A default
+	// module collecting stats and settings is added if missing.
+	Modules map[string]*Module `yaml:"modules"`
+	// Pools are groups of servers which are analysed as a whole.
+	Pools []*Pool `yaml:"pools"`
+}
+
+// Pool is a group of servers, e.g. the replicas behind a router.
+type Pool struct {
+	Name    string   `yaml:"name"`
+	Servers []string `yaml:"servers"`
+	// Discovered servers are added to the configured ones, and are scraped
+	// with the module of the pool.
+	DNSSDConfigs    []*DNSSDConfig    `yaml:"dns_sd_configs"`
+	FileSDConfigs   []*FileSDConfig   `yaml:"file_sd_configs"`
+	ConsulSDConfigs []*ConsulSDConfig `yaml:"consul_sd_configs"`
+	// Module is the module discovered servers are scraped with, "default" by
+	// default.
+	Module string `yaml:"module"`
+	// Consistency enables comparing sampled keys across the servers.
+	Consistency *ConsistencyCheck `yaml:"consistency"`
+	// Hash is the algorithm clients shard keys with, modulo, ketama or jump.
+	// If set, the load of the servers is compared with their keyspace share.
+	Hash string `yaml:"hash"`
+	// Weights of the servers for the hash algorithm, 1 by default.
+	Weights map[string]int `yaml:"weights"`
+	// Aggregate enables the pool totals and load spread across the servers.
+	Aggregate bool `yaml:"aggregate"`
+
+	// dialer connects to the servers with the TLS and authentication of the
+	// module.
+	dialer *Dialer
+
+	mu sync.Mutex
+	// groups are the last target groups of every discoverer.
+	groups [][]*targetGroup
+}
+
+// ConsistencyCheck configures the replica consistency check of a pool.
+type ConsistencyCheck struct {
+	// Interval is the time between two checks, 1m by default.
+	Interval time.Duration `yaml:"interval"`
+	// Timeout is the timeout of the commands, 10s by default.
+	Timeout time.Duration `yaml:"timeout"`
+	// SampleSize is the number of keys sampled from a metadump of one server,
+	// rotating between checks, 100 by default.
+	SampleSize int `yaml:"sample_size"`
+	// Keys are checked instead of sampled keys if set.
+	Keys []string `yaml:"keys"`
+}
+
+// Module configures how a target of /probe is collected.
+type Module struct {
+	// Timeout is the connect and read timeout, 1s by default.
+	Timeout time.Duration `yaml:"timeout"`
+	// Collectors are the enabled collectors, stats and settings by default.
+	Collectors []string `yaml:"collectors"`
+	// Probe configures a synthetic probe, no probe runs by default.
+	Probe *ModuleProbe `yaml:"probe"`
+	// Keys are checked for presence, TTL and size.
+	Keys []string `yaml:"keys"`
+	// ExpectedSettings are compared with the settings of the targets, like
+	// the expected settings of the flags.
+	ExpectedSettings map[string]string `yaml:"expected_settings"`
+
+	TLS      *TLSConfig `yaml:"tls"`
+	Username string     `yaml:"username"`
+	Password string     `yaml:"password"`
+
+	opts ExporterOpts
+}
+
+// ModuleProbe configures the synthetic probe of a module.
+type ModuleProbe struct {
+	// Op is set_get, noop or meta.
+	Op  string        `yaml:"op"`
+	Key string        `yaml:"key"`
+	TTL time.Duration `yaml:"ttl"`
+}
+
+// TLSConfig configures TLS connections to memcached 1.5.13 and later.
+type TLSConfig struct {
+	CAFile             string `yaml:"ca_file"`
+	CertFile           string `yaml:"cert_file"`
+	KeyFile            string `yaml:"key_file"`
+	ServerName         string `yaml:"server_name"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+// loadConfig reads and validates a configuration file.
+func loadConfig(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return parseConfig(content)
+}
+
+func parseConfig(content []byte) (*Config, error) {
+	cfg := &Config{}
+	if err := yaml.UnmarshalStrict(content, cfg); err != nil {
+		return nil, err
+	}
+	if cfg.Modules == nil {
+		cfg.Modules = map[string]*Module{}
+	}
+	if _, ok := cfg.Modules["default"]; !ok {
+		cfg.Modules["default"] = nil
+	}
+	for name, m := range cfg.Modules {
+		if m == nil {
+			m = &Module{}
+			cfg.Modules[name] = m
+		}
+		if err := m.init(); err != nil {
+			return nil, fmt.Errorf("module %s: %s", name, err)
+		}
+	}
+	names := map[string]bool{}
+	for _, p := range cfg.Pools {
+		if p.Name == "" || names[p.Name] {
+			return nil, fmt.Errorf("pool names must be unique and not empty, have %q", p.Name)
+		}
+		names[p.Name] = true
+		if err := p.init(); err != nil {
+			return nil, fmt.Errorf("pool %s: %s", p.Name, err)
+		}
+		m, ok := cfg.Modules[p.Module]
+		if !ok {
+			return nil, fmt.Errorf("pool %s: unknown module %q", p.Name, p.Module)
+		}
+		p.dialer = m.opts.Dialer
+	}
+	return cfg, nil
+}
+
+// init applies the defaults of a pool.
+func (p *Pool) init() error {
+	for _, c := range p.DNSSDConfigs {
+		if err := c.init(); err != nil {
+			return err
+		}
+	}
+	for _, c := range p.FileSDConfigs {
+		if err := c.init(); err != nil {
+			return err
+		}
+	}
+	for _, c := range p.ConsulSDConfigs {
+		if err := c.init(); err != nil {
+			return err
+		}
+	}
+	discovered := len(p.discoverers()) > 0
+	if len(p.Servers) == 0 && !discovered {
+		return fmt.Errorf("no servers")
+	}
+	if p.Module == "" {
+		p.Module = "default"
+	}
+	if c := p.Consistency; c != nil {
+		if len(p.Servers) < 2 && !discovered {
+			return fmt.Errorf("consistency checks need at least two servers")
+		}
+		if c.Interval < 0 {
+			return fmt.Errorf("negative consistency interval %s", c.Interval)
+		}
+		if c.Timeout < 0 {
+			return fmt.Errorf("negative consistency timeout %s", c.Timeout)
+		}
+		if c.Interval == 0 {
+			c.Interval = time.Minute
+		}
+		if c.Timeout == 0 {
+			c.Timeout = 10 * time.Second
+		}
+		if c.SampleSize == 0 {
+			c.SampleSize = 100
+		}
+	}
+	for server, w := range p.Weights {
+		if w < 0 {
+			return fmt.Errorf("negative weight of %s", server)
+		}
+	}
+	switch p.Hash {
+	case "", hashModulo, hashKetama, hashJump:
+	default:
+		return fmt.Errorf("unknown hash algorithm %q", p.Hash)
+	}
+	return nil
+}
+
+// init applies the defaults and builds the exporter options of a module.
+func (m *Module) init() error {
+	if m.Timeout == 0 {
+		m.Timeout = time.Second
+	}
+	if m.Collectors == nil {
+		m.Collectors = []string{collectorStats, collectorSettings}
+	}
+
+	m.opts = ExporterOpts{DisableStats: true, DisableSettings: true, Keys: m.Keys, ExpectedSettings: m.ExpectedSettings}
+	for _, c := range m.Collectors {
+		switch c {
+		case collectorStats:
+			m.opts.DisableStats = false
+		case collectorSettings:
+			m.opts.DisableSettings = false
+		case collectorDerived:
+			m.opts.Derived = true
+		case collectorPassthrough:
+			m.opts.Passthrough = true
+		default:
+			return fmt.Errorf("unknown collector %q", c)
+		}
+	}
+	if len(m.ExpectedSettings) > 0 && m.opts.DisableSettings {
+		return fmt.Errorf("expected settings need the %s collector", collectorSettings)
+	}
+
+	if m.TLS != nil || m.Username != "" {
+		m.opts.Dialer = &Dialer{Username: m.Username, Password: m.Password}
+		if m.TLS != nil {
+			var err error
+			if m.opts.Dialer.TLS, err = m.TLS.config(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if m.Probe != nil {
+		p := ProbeOpts{Op: m.Probe.Op, Key: m.Probe.Key, TTL: m.Probe.TTL}
+		switch p.Op {
+		case "", probeSetGet:
+			p.Op = probeSetGet
+			// The canary key is written with the memcache client.
+			if m.opts.Dialer != nil {
+				return fmt.Errorf("%s probes don't support TLS or authentication", probeSetGet)
+			}
+		case probeNoop, probeMeta:
+		default:
+			return fmt.Errorf("unknown probe op %q", p.Op)
+		}
+		if p.Key == "" {
+			p.Key = "memcached_exporter_probe"
+		}
+		if p.TTL == 0 {
+			p.TTL = time.Minute
+		}
+		m.opts.Probe = true
+		m.opts.ProbeOpts = p
+	}
+	return nil
+}
+
+func (c *TLSConfig) config() (*tls.Config, error) {
+	cfg := &tls.Config{ServerName: c.ServerName, InsecureSkipVerify: c.InsecureSkipVerify}
+	if c.CAFile != "" {
+		ca, err := ioutil.ReadFile(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates found in %s", c.CAFile)
+		}
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+	return cfg, nil
+}
+
+// probeExporterTTL is the time after which the cached exporter of a target
+// which isn't probed anymore is dropped.
+const probeExporterTTL = time.Hour
+
+// probeExporter is the cached exporter of a module and target.
+type probeExporter struct {
+	registry *prometheus.Registry
+	used     time.Time
+}
+
+// probeHandler collects a target with a module, like the blackbox exporter:
+// /probe?target=host:port&module=name. The module defaults to "default". The
+// exporter of every module and target is kept between probes, so that restarts
+// and missing stats are tracked like for the exporter's own target.
+func probeHandler(cfg *Config) http.Handler {
+	var (
+		mu        sync.Mutex
+		exporters = map[[2]string]*probeExporter{}
+	)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "target parameter is missing", http.StatusBadRequest)
+			return
+		}
+		name := r.URL.Query().Get("module")
+		if name == "" {
+			name = "default"
+		}
+		m, ok := cfg.Modules[name]
+		if !ok {
+			http.Error(w, "unknown module "+name, http.StatusBadRequest)
+			return
+		}
+
+		now := time.Now()
+		mu.Lock()
+		for k, e := range exporters {
+			if now.Sub(e.used) > probeExporterTTL {
+				delete(exporters, k)
+			}
+		}
+		e, ok := exporters[[2]string{name, target}]
+		if !ok {
+			e = &probeExporter{registry: prometheus.NewRegistry()}
+			e.registry.MustRegister(NewExporter(target, m.Timeout, m.opts))
+			exporters[[2]string{name, target}] = e
+		}
+		e.used = now
+		mu.Unlock()
+
+		promhttp.HandlerFor(e.registry, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,116 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+modules:
+  deep:
+    timeout: 5s
+    collectors: [stats, settings, derived]
+    probe:
+      op: set_get
+  liveness:
+    collectors: []
+    probe:
+      op: noop
+  secure:
+    username: user
+    password: secret
+pools:
+  - name: cache
+    servers: [a:11211, b:11211]
+    module: secure
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := cfg.Modules["default"]; m == nil || m.Timeout != time.Second || m.opts.DisableStats || m.opts.DisableSettings {
+		t.Errorf("unexpected default module %+v", m)
+	}
+	if m := cfg.Modules["deep"]; m.Timeout != 5*time.Second || !m.opts.Derived || m.opts.ProbeOpts.Key != "memcached_exporter_probe" {
+		t.Errorf("unexpected deep module %+v", m)
+	}
+	if m := cfg.Modules["liveness"]; !m.opts.DisableStats || m.opts.ProbeOpts.Op != probeNoop {
+		t.Errorf("unexpected liveness module %+v", m)
+	}
+	if d := cfg.Pools[0].dialer; d == nil || d.Username != "user" || d.Password != "secret" {
+		t.Errorf("want pool dialer of the secure module, have %+v", d)
+	}
+
+	for _, invalid := range []string{
+		"modules: {m: {collectors: [unknown]}}",
+		"modules: {m: {probe: {op: unknown}}}",
+		"modules: {m: {username: user, probe: {op: set_get}}}",
+		"modules: {m: {collectors: [stats], expected_settings: {maxconns: '1024'}}}",
+		"pools: [{name: p, servers: [a, b], consistency: {interval: -1m}}]",
+		"pools: [{name: p, dns_sd_configs: [{names: [cache.svc], refresh_interval: -1s}]}]",
+		"pools: [{name: p, file_sd_configs: [{files: [targets.json], refresh_interval: -1s}]}]",
+		"pools: [{name: p, consul_sd_configs: [{services: [memcached], wait: -1s}]}]",
+		"unknown: true",
+	} {
+		if _, err := parseConfig([]byte(invalid)); err == nil {
+			t.Errorf("want error for %q", invalid)
+		}
+	}
+}
+
+func TestProbeHandler(t *testing.T) {
+	addr := fakeServer(t, map[string]string{
+		"stats\r\n":      "STAT pid 1\r\nSTAT version 1.6.9\r\nEND\r\n",
+		"stats slabs":    "STAT active_slabs 0\r\nEND\r\n",
+		"stats items":    "END\r\n",
+		"stats settings": "STAT maxconns 1024\r\nEND\r\n",
+		"mn":             "MN\r\n",
+	})
+	cfg, err := parseConfig([]byte("modules: {liveness: {collectors: [], probe: {op: noop}}, drift: {expected_settings: {maxconns: '4096'}}}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := probeHandler(cfg)
+
+	for _, c := range []struct {
+		query          string
+		code           int
+		want, unwanted string
+	}{
+		{"target=" + addr, 200, "memcached_up 1", "memcached_probe_success"},
+		{"target=" + addr + "&module=liveness", 200, "memcached_probe_success 1", "memcached_version"},
+		{"target=" + addr + "&module=liveness", 200, "memcached_up 1", "memcached_version"},
+		{"target=" + addr + "&module=drift", 200, `memcached_setting_drift{actual="1024",expected="4096",name="maxconns"} 1`, "memcached_probe_success"},
+		{"target=" + addr + "&module=unknown", 400, "unknown module", "memcached_up"},
+		{"module=liveness", 400, "target parameter is missing", "memcached_up"},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?"+c.query, nil))
+		body := rec.Body.String()
+		if rec.Code != c.code || !strings.Contains(body, c.want) || strings.Contains(body, c.unwanted) {
+			t.Errorf("%s: unexpected response %d:\n%s", c.query, rec.Code, body)
+		}
+	}
+
+	// The exporter of a target is kept between probes.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?target="+addr, nil))
+	if want := `memcached_exporter_missing_stats_total{key="uptime"} 2`; !strings.Contains(rec.Body.String(), want) {
+		t.Errorf("want %s after the second probe, have:\n%s", want, rec.Body.String())
+	}
+}
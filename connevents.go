@@ -0,0 +1,153 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// otherClients collects all connections once the maximum number of client
+	// buckets is reached.
+	otherClients = "_other"
+	// maxOpenConnections caps the number of tracked open connections, in case
+	// close events are lost.
+	maxOpenConnections = 1 << 16
+)
+
+// lifetimeBuckets are the buckets of the connection lifetime histogram, from
+// 10ms to a day.
+var lifetimeBuckets = []float64{0.01, 0.1, 1, 10, 60, 600, 3600, 86400}
+
+// ConnEventsOpts configures the connection event aggregator.
+type ConnEventsOpts struct {
+	// IPv4Mask and IPv6Mask are the prefix lengths client addresses are
+	// grouped by.
+	IPv4Mask, IPv6Mask int
+	// MaxClients caps the number of exported client buckets, further clients
+	// are aggregated as _other.
+	MaxClients int
+}
+
+// connEventsAggregator tracks the connections of the `watch connevents`
+// stream. Connection events look like
+// "ts=1560000000.123456 gid=1 type=conn_new rip=10.0.0.1 rport=43210 transport=tcp cfd=20"
+// and "... type=conn_close rip=10.0.0.1 rport=43210 transport=tcp reason=normal cfd=20".
+type connEventsAggregator struct {
+	opts ConnEventsOpts
+
+	mu      sync.Mutex
+	open    map[string]time.Time
+	clients map[string]bool
+
+	opened   *prometheus.CounterVec
+	closed   *prometheus.CounterVec
+	lifetime *prometheus.HistogramVec
+}
+
+func newConnEventsAggregator(opts ConnEventsOpts) *connEventsAggregator {
+	return &connEventsAggregator{
+		opts:    opts,
+		open:    map[string]time.Time{},
+		clients: map[string]bool{},
+		opened: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_connections_opened_total",
+			Help:      "Number of connections opened by client address bucket.",
+		}, []string{"client"}),
+		closed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "client_connections_closed_total",
+			Help:      "Number of connections closed by client address bucket and reason.",
+		}, []string{"client", "reason"}),
+		lifetime: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Name:      "client_connection_lifetime_seconds",
+			Help:      "Lifetime of the closed connections by client address bucket.",
+			Buckets:   lifetimeBuckets,
+		}, []string{"client"}),
+	}
+}
+
+func (a *connEventsAggregator) streams() []string {
+	return []string{"connevents"}
+}
+
+// client returns the bucket of a client address, or _other once the maximum
+// number of buckets is reached. Addresses which aren't IPs are used as is.
+func (a *connEventsAggregator) client(addr string) string {
+	c := addr
+	if ip := net.ParseIP(addr); ip != nil {
+		if ip4 := ip.To4(); ip4 != nil {
+			c = (&net.IPNet{IP: ip4.Mask(net.CIDRMask(a.opts.IPv4Mask, 32)), Mask: net.CIDRMask(a.opts.IPv4Mask, 32)}).String()
+		} else {
+			c = (&net.IPNet{IP: ip.Mask(net.CIDRMask(a.opts.IPv6Mask, 128)), Mask: net.CIDRMask(a.opts.IPv6Mask, 128)}).String()
+		}
+	}
+	if !a.clients[c] {
+		if a.opts.MaxClients > 0 && len(a.clients) >= a.opts.MaxClients {
+			return otherClients
+		}
+		a.clients[c] = true
+	}
+	return c
+}
+
+func (a *connEventsAggregator) observe(ev watchEvent) {
+	if ev.kind != "conn_new" && ev.kind != "conn_close" {
+		return
+	}
+	conn := ev.fields["rip"] + " " + ev.fields["rport"] + " " + ev.fields["cfd"]
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	client := a.client(ev.fields["rip"])
+	if ev.kind == "conn_new" {
+		if len(a.open) >= maxOpenConnections {
+			a.open = map[string]time.Time{}
+		}
+		a.open[conn] = ev.time
+		a.opened.WithLabelValues(client).Inc()
+		return
+	}
+	reason := ev.fields["reason"]
+	if reason == "" {
+		reason = "unknown"
+	}
+	a.closed.WithLabelValues(client, reason).Inc()
+	// Connections opened before the watch connection have no start time.
+	if start, ok := a.open[conn]; ok {
+		a.lifetime.WithLabelValues(client).Observe(ev.time.Sub(start).Seconds())
+		delete(a.open, conn)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (a *connEventsAggregator) Describe(ch chan<- *prometheus.Desc) {
+	a.opened.Describe(ch)
+	a.closed.Describe(ch)
+	a.lifetime.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (a *connEventsAggregator) Collect(ch chan<- prometheus.Metric) {
+	a.opened.Collect(ch)
+	a.closed.Collect(ch)
+	a.lifetime.Collect(ch)
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestConnEventsAggregator(t *testing.T) {
+	a := newConnEventsAggregator(ConnEventsOpts{IPv4Mask: 24, IPv6Mask: 64, MaxClients: 2})
+
+	for _, line := range []string{
+		"ts=1560000000.0 gid=1 type=conn_new rip=10.0.0.1 rport=40000 transport=tcp cfd=20",
+		"ts=1560000000.0 gid=2 type=conn_new rip=10.0.0.2 rport=40001 transport=tcp cfd=21",
+		"ts=1560000000.5 gid=3 type=conn_close rip=10.0.0.2 rport=40001 transport=tcp reason=normal cfd=21",
+		"ts=1560000001.0 gid=4 type=conn_new rip=fd00::1 rport=40002 transport=tcp cfd=22",
+		"ts=1560000100.0 gid=5 type=conn_close rip=10.0.0.1 rport=40000 transport=tcp reason=idle_timeout cfd=20",
+		"ts=1560000100.0 gid=6 type=conn_new rip=192.168.0.1 rport=40003 transport=tcp cfd=23",
+		// Opened before the watch connection.
+		"ts=1560000200.0 gid=7 type=conn_close rip=10.0.0.3 rport=39999 transport=tcp reason=error cfd=19",
+	} {
+		ev, err := parseWatchLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.observe(ev)
+	}
+
+	for _, c := range []struct {
+		client string
+		opened float64
+	}{
+		{"10.0.0.0/24", 2},
+		{"fd00::/64", 1},
+		{"_other", 1},
+	} {
+		if v := counterValue(t, a.opened.WithLabelValues(c.client)); v != c.opened {
+			t.Errorf("%s: want %f opened connections, have %f", c.client, c.opened, v)
+		}
+	}
+	for _, reason := range []string{"normal", "idle_timeout", "error"} {
+		if v := counterValue(t, a.closed.WithLabelValues("10.0.0.0/24", reason)); v != 1 {
+			t.Errorf("want 1 connection closed for reason %s, have %f", reason, v)
+		}
+	}
+
+	var pb dto.Metric
+	if err := a.lifetime.WithLabelValues("10.0.0.0/24").(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	if h := pb.GetHistogram(); h.GetSampleCount() != 2 || h.GetSampleSum() != 100.5 {
+		t.Errorf("unexpected lifetime histogram %v", h)
+	}
+	if len(a.open) != 2 {
+		t.Errorf("want 2 open connections, have %d", len(a.open))
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// invalidLabelChars are replaced in the names of metadata labels.
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// ConsulSDConfig discovers the servers of a pool from the health endpoint of
+// the Consul API, with blocking queries.
+type ConsulSDConfig struct {
+	// Server is the address of the Consul agent, localhost:8500 by default.
+	Server string `yaml:"server"`
+	// Scheme is http, the default, or https.
+	Scheme     string   `yaml:"scheme"`
+	Token      string   `yaml:"token"`
+	Datacenter string   `yaml:"datacenter"`
+	Services   []string `yaml:"services"`
+	// SkipCritical skips instances with a critical health check.
+	SkipCritical bool `yaml:"skip_critical"`
+	// Wait is the maximum duration of a blocking query, 5m by default.
+	Wait time.Duration `yaml:"wait"`
+	// RetryInterval is the time before a failed query is retried, 30s by
+	// default.
+	RetryInterval time.Duration `yaml:"retry_interval"`
+}
+
+// consulServiceEntry is an entry of /v1/health/service/<name>.
+type consulServiceEntry struct {
+	Node struct {
+		Node    string
+		Address string
+	}
+	Service struct {
+		ID      string
+		Service string
+		Address string
+		Port    int
+		Tags    []string
+		Meta    map[string]string
+	}
+	Checks []struct {
+		Status string
+	}
+}
+
+// init applies the defaults of a Consul discovery.
+func (c *ConsulSDConfig) init() error {
+	if len(c.Services) == 0 {
+		return fmt.Errorf("no Consul services")
+	}
+	if c.Server == "" {
+		c.Server = "localhost:8500"
+	}
+	switch c.Scheme {
+	case "":
+		c.Scheme = "http"
+	case "http", "https":
+	default:
+		return fmt.Errorf("unknown scheme %q", c.Scheme)
+	}
+	if c.Wait < 0 {
+		return fmt.Errorf("negative wait %s", c.Wait)
+	}
+	if c.RetryInterval < 0 {
+		return fmt.Errorf("negative retry interval %s", c.RetryInterval)
+	}
+	if c.Wait == 0 {
+		c.Wait = 5 * time.Minute
+	}
+	if c.RetryInterval == 0 {
+		c.RetryInterval = 30 * time.Second
+	}
+	return nil
+}
+
+// run watches every service with blocking queries and sends the groups of all
+// services whenever one of them changed. Pending queries are canceled once
+// done is closed.
+func (c *ConsulSDConfig) run(ch chan<- []*targetGroup, done <-chan struct{}) {
+	var (
+		mu       sync.Mutex
+		services = map[string][]*targetGroup{}
+		wg       sync.WaitGroup
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-done:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	client := &http.Client{Timeout: c.Wait + c.Wait/16 + 10*time.Second}
+	for _, service := range c.Services {
+		wg.Add(1)
+		go func(service string) {
+			defer wg.Done()
+			var index uint64
+			for {
+				groups, next, err := c.fetch(ctx, client, service, index)
+				if ctx.Err() != nil {
+					return
+				}
+				if err != nil {
+					log.Errorf("Failed to query Consul service %s: %s", service, err)
+					select {
+					case <-done:
+						return
+					case <-time.After(c.RetryInterval):
+					}
+					continue
+				}
+				// The index only increases, unless Consul's state was reset.
+				if next < index {
+					next = 0
+				}
+				if next == index {
+					continue
+				}
+				index = next
+
+				mu.Lock()
+				services[service] = groups
+				var all []*targetGroup
+				for _, s := range c.Services {
+					all = append(all, services[s]...)
+				}
+				mu.Unlock()
+				select {
+				case ch <- all:
+				case <-done:
+					return
+				}
+			}
+		}(service)
+	}
+	wg.Wait()
+}
+
+// fetch queries the instances of a service. It blocks until the index of the
+// service differs from the given index or the wait time passed, and returns
+// the new index.
+func (c *ConsulSDConfig) fetch(ctx context.Context, client *http.Client, service string, index uint64) ([]*targetGroup, uint64, error) {
+	params := url.Values{}
+	params.Set("index", strconv.FormatUint(index, 10))
+	params.Set("wait", strconv.FormatInt(int64(c.Wait/time.Millisecond), 10)+"ms")
+	if c.Datacenter != "" {
+		params.Set("dc", c.Datacenter)
+	}
+	u := url.URL{Scheme: c.Scheme, Host: c.Server, Path: "/v1/health/service/" + service, RawQuery: params.Encode()}
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Token != "" {
+		req.Header.Set("X-Consul-Token", c.Token)
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, 0, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	next, err := strconv.ParseUint(resp.Header.Get("X-Consul-Index"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid X-Consul-Index header: %s", err)
+	}
+	var entries []consulServiceEntry
+	if err := json.NewDecoder(resp.Body).Decode(&entries); err != nil {
+		return nil, 0, err
+	}
+
+	groups := []*targetGroup{}
+	for _, e := range entries {
+		if c.SkipCritical && e.critical() {
+			continue
+		}
+		groups = append(groups, e.group())
+	}
+	return groups, next, nil
+}
+
+// critical returns whether a check of the instance is critical.
+func (e consulServiceEntry) critical() bool {
+	for _, check := range e.Checks {
+		if check.Status == "critical" {
+			return true
+		}
+	}
+	return false
+}
+
+// group returns the instance as a group with its tags and metadata as
+// labels. Tags are joined like in Prometheus' Consul discovery, e.g.
+// ",primary,v1,".
+func (e consulServiceEntry) group() *targetGroup {
+	address := e.Service.Address
+	if address == "" {
+		address = e.Node.Address
+	}
+	labels := map[string]string{
+		"consul_service": e.Service.Service,
+		"consul_node":    e.Node.Node,
+	}
+	if len(e.Service.Tags) > 0 {
+		tags := append([]string{}, e.Service.Tags...)
+		sort.Strings(tags)
+		labels["consul_tags"] = "," + strings.Join(tags, ",") + ","
+	}
+	for k, v := range e.Service.Meta {
+		labels["consul_meta_"+invalidLabelChars.ReplaceAllString(k, "_")] = v
+	}
+	return &targetGroup{
+		Targets: []string{net.JoinHostPort(address, strconv.Itoa(e.Service.Port))},
+		Labels:  labels,
+	}
+}
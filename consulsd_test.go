@@ -0,0 +1,188 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// consulStandIn serves /v1/health/service/memcached like Consul. Queries with
+// the current index block until the index changes or the wait time passed.
+type consulStandIn struct {
+	mu      sync.Mutex
+	index   uint64
+	entries string
+	changed chan struct{}
+	queries []url.Values
+}
+
+func (c *consulStandIn) update(entries string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.index++
+	c.entries = entries
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+func (c *consulStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/health/service/memcached" || r.Header.Get("X-Consul-Token") != "secret" {
+		http.NotFound(w, r)
+		return
+	}
+	c.mu.Lock()
+	c.queries = append(c.queries, r.URL.Query())
+	index, changed := c.index, c.changed
+	c.mu.Unlock()
+
+	if r.URL.Query().Get("index") == strconv.FormatUint(index, 10) {
+		wait, _ := time.ParseDuration(r.URL.Query().Get("wait"))
+		select {
+		case <-changed:
+		case <-time.After(wait):
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	w.Header().Set("X-Consul-Index", strconv.FormatUint(c.index, 10))
+	w.Write([]byte(c.entries))
+}
+
+const consulEntries = `[
+  {
+    "Node": {"Node": "node-1", "Address": "10.0.0.1"},
+    "Service": {"ID": "memcached-1", "Service": "memcached", "Address": "", "Port": 11211, "Tags": ["v1", "primary"], "Meta": {"rack": "r1", "cache-tier": "hot"}},
+    "Checks": [{"Status": "passing"}]
+  },
+  {
+    "Node": {"Node": "node-2", "Address": "10.0.0.2"},
+    "Service": {"ID": "memcached-2", "Service": "memcached", "Address": "10.0.1.2", "Port": 11212, "Tags": [], "Meta": null},
+    "Checks": [{"Status": "passing"}, {"Status": "critical"}]
+  }
+]`
+
+func TestConsulSD(t *testing.T) {
+	standIn := &consulStandIn{index: 1, entries: consulEntries, changed: make(chan struct{})}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	c := &ConsulSDConfig{Server: u.Host, Token: "secret", Datacenter: "dc1", Services: []string{"memcached"}, Wait: 50 * time.Millisecond}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	first := &targetGroup{
+		Targets: []string{"10.0.0.1:11211"},
+		Labels: map[string]string{
+			"consul_service":         "memcached",
+			"consul_node":            "node-1",
+			"consul_tags":            ",primary,v1,",
+			"consul_meta_rack":       "r1",
+			"consul_meta_cache_tier": "hot",
+		},
+	}
+	second := &targetGroup{
+		Targets: []string{"10.0.1.2:11212"},
+		Labels:  map[string]string{"consul_service": "memcached", "consul_node": "node-2"},
+	}
+
+	groups, index, err := c.fetch(context.Background(), http.DefaultClient, "memcached", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []*targetGroup{first, second}; index != 1 || !reflect.DeepEqual(groups, want) {
+		t.Errorf("want %v at index 1, have %v at index %d", want, groups, index)
+	}
+	if q := standIn.queries[0]; q.Get("dc") != "dc1" || q.Get("index") != "0" || q.Get("wait") != "50ms" {
+		t.Errorf("unexpected query %v", q)
+	}
+
+	// Critical instances are only skipped if configured.
+	c.SkipCritical = true
+	ch := make(chan []*targetGroup)
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		c.run(ch, done)
+		close(stopped)
+	}()
+	if have, want := <-ch, []*targetGroup{first}; !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// Blocking queries return once the service changes.
+	standIn.update(`[]`)
+	select {
+	case have := <-ch:
+		if len(have) != 0 {
+			t.Errorf("want no targets, have %v", have)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no update after the service changed")
+	}
+
+	// Closing done cancels the pending blocking query.
+	close(done)
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run didn't return after stop")
+	}
+}
+
+func TestConsulSDScrape(t *testing.T) {
+	standIn := &consulStandIn{index: 1, entries: consulEntries, changed: make(chan struct{})}
+	server := httptest.NewServer(standIn)
+	defer server.Close()
+	u, _ := url.Parse(server.URL)
+
+	c := &ConsulSDConfig{Server: u.Host, Token: "secret", Services: []string{"memcached"}}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	groups, _, err := c.fetch(context.Background(), http.DefaultClient, "memcached", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The tagged instance with metadata and the untagged one are both
+	// scraped, although their labels differ.
+	a := fakeServer(t, map[string]string{"stats": "STAT version 1.5.16\r\nEND\r\n"})
+	b := fakeServer(t, map[string]string{"stats": "STAT version 1.5.16\r\nEND\r\n"})
+	groups[0].Targets, groups[1].Targets = []string{a}, []string{b}
+	cfg, err := parseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTargetScraper(cfg.Modules)
+	pool := &Pool{Name: "cache", ConsulSDConfigs: []*ConsulSDConfig{c}}
+	if err := pool.init(); err != nil {
+		t.Fatal(err)
+	}
+	pool.groups = [][]*targetGroup{groups}
+	s.sync(pool)
+	want := []string{a, b}
+	sort.Strings(want)
+	if have := gatheredServers(t, s); !reflect.DeepEqual(have, want) {
+		t.Errorf("want servers %v, have %v", want, have)
+	}
+}
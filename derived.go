@@ -0,0 +1,73 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	hitRatioDesc            = newDesc("", "hit_ratio", "Ratio of get hits to all gets since the server started.")
+	memoryFillRatioDesc     = newDesc("", "memory_fill_ratio", "Ratio of bytes used to store items to the memory limit.")
+	memoryFragmentationDesc = newDesc("", "memory_fragmentation_ratio", "Ratio of bytes allocated to slab pages to bytes used to store items.")
+	slabWastedBytesDesc     = newDesc(subsystemSlab, "wasted_bytes", "Number of bytes of allocated chunks not used by item data in this slab class.", "slab")
+	slabFillRatioDesc       = newDesc(subsystemSlab, "fill_ratio", "Ratio of used chunks to allocated chunks in this slab class.", "slab")
+	derivedDescs            = []*prometheus.Desc{hitRatioDesc, memoryFillRatioDesc, memoryFragmentationDesc, slabWastedBytesDesc, slabFillRatioDesc}
+)
+
+// collectDerived exports efficiency metrics computed from the general and per
+// slab class stats. Ratios with a zero denominator are not exported.
+func collectDerived(ch chan<- prometheus.Metric, stats map[string]string, slabs map[int]map[string]string) {
+	if hits, err := strconv.ParseFloat(stats["get_hits"], 64); err == nil {
+		if gets, err := sum(stats, "get_hits", "get_misses"); err == nil && gets > 0 {
+			ch <- prometheus.MustNewConstMetric(hitRatioDesc, prometheus.GaugeValue, hits/gets)
+		}
+	}
+	collectRatio(ch, memoryFillRatioDesc, stats, "bytes", "limit_maxbytes")
+	collectRatio(ch, memoryFragmentationDesc, stats, "total_malloced", "bytes")
+
+	for slab, v := range slabs {
+		slab := strconv.Itoa(slab)
+		collectRatio(ch, slabFillRatioDesc, v, "used_chunks", "total_chunks", slab)
+
+		chunks, err := strconv.ParseFloat(v["total_chunks"], 64)
+		if err != nil {
+			continue
+		}
+		size, err := strconv.ParseFloat(v["chunk_size"], 64)
+		if err != nil {
+			continue
+		}
+		requested, err := strconv.ParseFloat(v["mem_requested"], 64)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(slabWastedBytesDesc, prometheus.GaugeValue, chunks*size-requested, slab)
+	}
+}
+
+// collectRatio exports the ratio of the numerator to the denominator stat.
+func collectRatio(ch chan<- prometheus.Metric, desc *prometheus.Desc, stats map[string]string, numerator, denominator string, labelValues ...string) {
+	n, err := strconv.ParseFloat(stats[numerator], 64)
+	if err != nil {
+		return
+	}
+	d, err := strconv.ParseFloat(stats[denominator], 64)
+	if err != nil || d == 0 {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, n/d, labelValues...)
+}
@@ -0,0 +1,64 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectDerived(t *testing.T) {
+	f := statsFixtures["1.6.9"]
+	slabs := map[int]map[string]string{
+		1: f.slabs[1],
+		2: {"chunk_size": "120", "total_chunks": "0", "used_chunks": "0", "mem_requested": "0"},
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	collectDerived(ch, f.stats, slabs)
+	close(ch)
+
+	have := map[string]float64{}
+	for m := range ch {
+		k, v := metricKey(t, m)
+		have[k] = v
+	}
+
+	for _, tc := range []struct {
+		desc  *prometheus.Desc
+		slab  string
+		value float64
+	}{
+		{hitRatioDesc, "", 0.75},
+		{memoryFillRatioDesc, "", 262.0 / 67108864},
+		{memoryFragmentationDesc, "", 2097152.0 / 262},
+		{slabWastedBytesDesc, "1", 10922*96 - 68},
+		{slabFillRatioDesc, "1", 1.0 / 10922},
+		{slabWastedBytesDesc, "2", 0},
+	} {
+		v, ok := have[tc.desc.String()+tc.slab]
+		if !ok {
+			t.Errorf("want %s %q to be exported", tc.desc, tc.slab)
+			continue
+		}
+		if math.Abs(v-tc.value) > 1e-9 {
+			t.Errorf("want %s %q to be %v, have %v", tc.desc, tc.slab, tc.value, v)
+		}
+	}
+	if _, ok := have[slabFillRatioDesc.String()+"2"]; ok {
+		t.Error("want no fill ratio for a slab class without chunks")
+	}
+}
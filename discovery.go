@@ -0,0 +1,248 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+)
+
+// targetGroup is a group of discovered servers with common labels, like the
+// groups of Prometheus' file_sd files.
+type targetGroup struct {
+	Targets []string          `yaml:"targets" json:"targets"`
+	Labels  map[string]string `yaml:"labels" json:"labels"`
+}
+
+// discoverer sends the complete target groups of a source whenever they are
+// refreshed. It returns once done is closed, a nil done never closes.
+type discoverer interface {
+	run(ch chan<- []*targetGroup, done <-chan struct{})
+}
+
+// target is a discovered server with its labels.
+type target struct {
+	address string
+	labels  map[string]string
+}
+
+// key identifies a target by its address and labels.
+func (t target) key() string {
+	var labels []string
+	for k, v := range t.labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+	return t.address + "{" + strings.Join(labels, ",") + "}"
+}
+
+// discoverers returns the discoverers configured for a pool.
+func (p *Pool) discoverers() []discoverer {
+	var ds []discoverer
+	for _, c := range p.DNSSDConfigs {
+		ds = append(ds, c)
+	}
+	for _, c := range p.FileSDConfigs {
+		ds = append(ds, c)
+	}
+	for _, c := range p.ConsulSDConfigs {
+		ds = append(ds, c)
+	}
+	return ds
+}
+
+// discover runs the discoverers of a pool until done is closed, and calls
+// changed after every refresh.
+func (p *Pool) discover(changed func(*Pool), done <-chan struct{}) {
+	ds := p.discoverers()
+	p.mu.Lock()
+	p.groups = make([][]*targetGroup, len(ds))
+	p.mu.Unlock()
+	for i, d := range ds {
+		ch := make(chan []*targetGroup)
+		go func(d discoverer) {
+			d.run(ch, done)
+			close(ch)
+		}(d)
+		go func(i int) {
+			for groups := range ch {
+				p.mu.Lock()
+				p.groups[i] = groups
+				p.mu.Unlock()
+				changed(p)
+			}
+		}(i)
+	}
+}
+
+// targets returns the discovered servers of a pool. Servers discovered more
+// than once keep the labels of the first group.
+func (p *Pool) targets() []target {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var targets []target
+	seen := map[string]bool{}
+	for _, groups := range p.groups {
+		for _, g := range groups {
+			for _, address := range g.Targets {
+				if seen[address] {
+					continue
+				}
+				seen[address] = true
+				targets = append(targets, target{address: address, labels: g.Labels})
+			}
+		}
+	}
+	return targets
+}
+
+// servers returns the configured and the discovered servers of a pool.
+func (p *Pool) servers() []string {
+	servers := append([]string{}, p.Servers...)
+	seen := map[string]bool{}
+	for _, s := range servers {
+		seen[s] = true
+	}
+	for _, t := range p.targets() {
+		if !seen[t.address] {
+			servers = append(servers, t.address)
+		}
+	}
+	return servers
+}
+
+// reservedLabels are the label names of the metrics of a target. Discovered
+// labels with these names are prefixed with exported_, like Prometheus does
+// for target labels conflicting with the scraped ones.
+var reservedLabels = map[string]bool{
+	"pool": true, "server": true,
+	"version": true, "name": true, "expected": true, "actual": true,
+	"command": true, "status": true, "slab": true, "key": true, "op": true,
+	"layout": true, "metric": true, "prefix": true, "window": true,
+	"cache_size_bytes": true, "client": true, "reason": true, "type": true,
+}
+
+// targetLabels returns the labels added to the metrics of a target of a pool.
+// Discovered labels starting with __ are dropped like after Prometheus'
+// relabeling.
+func targetLabels(pool string, t target) prometheus.Labels {
+	var names []string
+	for name := range t.labels {
+		if !strings.HasPrefix(name, "__") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	labels := prometheus.Labels{}
+	for _, name := range names {
+		if !reservedLabels[name] {
+			labels[name] = t.labels[name]
+		}
+	}
+	for _, name := range names {
+		if !reservedLabels[name] {
+			continue
+		}
+		exported := "exported_" + name
+		for _, ok := labels[exported]; ok; _, ok = labels[exported] {
+			exported = "exported_" + exported
+		}
+		labels[exported] = t.labels[name]
+	}
+	labels["pool"] = pool
+	labels["server"] = t.address
+	return labels
+}
+
+// targetScraper scrapes the discovered servers of pools with the module of the
+// pool. The metrics of every server are labeled with the pool, its address
+// and the discovered labels. Every server has its own registry, as the
+// discovered labels may differ between servers.
+type targetScraper struct {
+	modules map[string]*Module
+
+	mu sync.Mutex
+	// scraped holds the registered exporters by pool and target key.
+	scraped map[string]map[string]*scrapedTarget
+}
+
+type scrapedTarget struct {
+	registry *prometheus.Registry
+	exporter *Exporter
+}
+
+func newTargetScraper(modules map[string]*Module) *targetScraper {
+	return &targetScraper{
+		modules: modules,
+		scraped: map[string]map[string]*scrapedTarget{},
+	}
+}
+
+// Gather implements prometheus.Gatherer by gathering the registries of all
+// targets.
+func (s *targetScraper) Gather() ([]*dto.MetricFamily, error) {
+	var gs prometheus.Gatherers
+	s.mu.Lock()
+	for _, scraped := range s.scraped {
+		for _, st := range scraped {
+			gs = append(gs, st.registry)
+		}
+	}
+	s.mu.Unlock()
+	return gs.Gather()
+}
+
+// sync registers the exporters of new targets of a pool and unregisters the
+// ones of vanished targets.
+func (s *targetScraper) sync(p *Pool) {
+	want := map[string]target{}
+	for _, t := range p.targets() {
+		want[t.key()] = t
+	}
+	m := s.modules[p.Module]
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scraped, ok := s.scraped[p.Name]
+	if !ok {
+		scraped = map[string]*scrapedTarget{}
+		s.scraped[p.Name] = scraped
+	}
+	for k, st := range scraped {
+		if _, ok := want[k]; !ok {
+			delete(scraped, k)
+			log.Infof("Removed server %s from pool %s", st.exporter.address, p.Name)
+		}
+	}
+	for k, t := range want {
+		if _, ok := scraped[k]; ok {
+			continue
+		}
+		st := &scrapedTarget{
+			registry: prometheus.NewRegistry(),
+			exporter: NewExporter(t.address, m.Timeout, m.opts),
+		}
+		if err := prometheus.WrapRegistererWith(targetLabels(p.Name, t), st.registry).Register(st.exporter); err != nil {
+			log.Errorf("Failed to add server %s to pool %s: %s", t.address, p.Name, err)
+			continue
+		}
+		scraped[k] = st
+		log.Infof("Added server %s to pool %s", t.address, p.Name)
+	}
+}
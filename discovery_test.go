@@ -0,0 +1,154 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// gatheredServers returns the server labels of memcached_up in a registry.
+func gatheredServers(t *testing.T, s *targetScraper) []string {
+	mfs, err := s.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	servers := []string{}
+	for _, mf := range mfs {
+		if mf.GetName() != "memcached_up" {
+			continue
+		}
+		for _, m := range mf.GetMetric() {
+			for _, l := range m.GetLabel() {
+				if l.GetName() == "server" {
+					servers = append(servers, l.GetValue())
+				}
+			}
+		}
+	}
+	sort.Strings(servers)
+	return servers
+}
+
+func TestTargetScraper(t *testing.T) {
+	a := fakeServer(t, map[string]string{"stats": "STAT version 1.5.16\r\nEND\r\n"})
+	b := fakeServer(t, map[string]string{"stats": "STAT version 1.5.16\r\nEND\r\n"})
+
+	cfg, err := parseConfig(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newTargetScraper(cfg.Modules)
+	pool := &Pool{Name: "cache", DNSSDConfigs: []*DNSSDConfig{{Names: []string{"cache.svc"}}}}
+	if err := pool.init(); err != nil {
+		t.Fatal(err)
+	}
+
+	pool.groups = [][]*targetGroup{{{Targets: []string{a, b}}}}
+	s.sync(pool)
+	want := []string{a, b}
+	sort.Strings(want)
+	if have := gatheredServers(t, s); !reflect.DeepEqual(have, want) {
+		t.Errorf("want servers %v, have %v", want, have)
+	}
+	if have, want := pool.servers(), []string{a, b}; !reflect.DeepEqual(have, want) {
+		t.Errorf("want pool servers %v, have %v", want, have)
+	}
+
+	pool.groups = [][]*targetGroup{{{Targets: []string{b}}}}
+	s.sync(pool)
+	if have, want := gatheredServers(t, s), []string{b}; !reflect.DeepEqual(have, want) {
+		t.Errorf("want servers %v, have %v", want, have)
+	}
+
+	// Groups with different label names are scraped side by side.
+	pool.groups = [][]*targetGroup{{
+		{Targets: []string{a}, Labels: map[string]string{"consul_service": "memcached"}},
+		{Targets: []string{b}, Labels: map[string]string{"consul_service": "memcached", "consul_tags": ",v1,"}},
+	}}
+	s.sync(pool)
+	if have := gatheredServers(t, s); !reflect.DeepEqual(have, want) {
+		t.Errorf("want servers %v with different label names, have %v", want, have)
+	}
+}
+
+func TestTargetLabels(t *testing.T) {
+	have := targetLabels("cache", target{
+		address: "10.0.0.1:11211",
+		labels: map[string]string{
+			"zone":          "a",
+			"server":        "cache-1",
+			"slab":          "x",
+			"exported_slab": "y",
+			"__meta_zone":   "a",
+		},
+	})
+	want := prometheus.Labels{
+		"pool":                   "cache",
+		"server":                 "10.0.0.1:11211",
+		"zone":                   "a",
+		"exported_server":        "cache-1",
+		"exported_slab":          "y",
+		"exported_exported_slab": "x",
+	}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+}
+
+// TestReservedLabels checks that the reserved labels cover the variable
+// labels of all metrics of an exporter.
+func TestReservedLabels(t *testing.T) {
+	e := NewExporter("localhost:11211", time.Second, ExporterOpts{
+		ExpectedSettings:   map[string]string{"maxconns": "1024"},
+		Passthrough:        true,
+		Derived:            true,
+		SlabRecommendation: true,
+		Keyspace:           true,
+		KeyspaceOpts:       KeyspaceOpts{PerClass: true},
+		Watch:              true,
+		WatchAggregators: []watchAggregator{
+			newConnEventsAggregator(ConnEventsOpts{}),
+			newEvictionAggregator(EvictionOpts{}),
+			newHotKeysAggregator("localhost:11211", HotKeysOpts{Top: 1, Window: time.Minute}),
+			newMRCAggregator(MRCOpts{}),
+			newUniqueKeysAggregator(UniqueKeysOpts{Windows: []time.Duration{time.Hour}}),
+		},
+		Probe: true,
+		Keys:  []string{"foo"},
+	})
+	ch := make(chan *prometheus.Desc)
+	go func() {
+		e.Describe(ch)
+		close(ch)
+	}()
+	variableLabels := regexp.MustCompile(`variableLabels: \[(.*)\]`)
+	for d := range ch {
+		m := variableLabels.FindStringSubmatch(d.String())
+		if m == nil {
+			t.Fatalf("unexpected descriptor %s", d)
+		}
+		for _, name := range strings.Fields(m[1]) {
+			if !reservedLabels[name] {
+				t.Errorf("label %s of %s is not reserved", name, d)
+			}
+		}
+	}
+}
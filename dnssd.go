@@ -0,0 +1,132 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+)
+
+// The lookup functions are replaced in tests.
+var (
+	lookupSRV = net.LookupSRV
+	lookupIP  = net.LookupIP
+)
+
+// DNSSDConfig discovers the servers of a pool from DNS records. Every
+// resolved address is a separate server.
+type DNSSDConfig struct {
+	Names []string `yaml:"names"`
+	// Type is SRV, the default, A or AAAA.
+	Type string `yaml:"type"`
+	// Port is the port of the servers of A and AAAA records, 11211 by
+	// default.
+	Port int `yaml:"port"`
+	// RefreshInterval is the time between two lookups, 30s by default.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+}
+
+// init applies the defaults of a DNS discovery.
+func (c *DNSSDConfig) init() error {
+	if len(c.Names) == 0 {
+		return fmt.Errorf("no DNS names")
+	}
+	switch c.Type {
+	case "":
+		c.Type = "SRV"
+	case "SRV", "A", "AAAA":
+	default:
+		return fmt.Errorf("unknown DNS record type %q", c.Type)
+	}
+	if c.Port == 0 {
+		c.Port = 11211
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("negative refresh interval %s", c.RefreshInterval)
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = 30 * time.Second
+	}
+	return nil
+}
+
+func (c *DNSSDConfig) run(ch chan<- []*targetGroup, done <-chan struct{}) {
+	for {
+		var groups []*targetGroup
+		for _, name := range c.Names {
+			targets, err := c.lookup(name)
+			if err != nil {
+				log.Errorf("Failed to resolve %s: %s", name, err)
+				groups = nil
+				break
+			}
+			groups = append(groups, &targetGroup{Targets: targets})
+		}
+		// Keep the previous servers if a lookup failed.
+		if groups != nil {
+			select {
+			case ch <- groups:
+			case <-done:
+				return
+			}
+		}
+		select {
+		case <-time.After(c.RefreshInterval):
+		case <-done:
+			return
+		}
+	}
+}
+
+// lookup resolves a name to the addresses of its servers.
+func (c *DNSSDConfig) lookup(name string) ([]string, error) {
+	if c.Type != "SRV" {
+		return c.lookupIP(name, c.Port)
+	}
+	_, srvs, err := lookupSRV("", "", name)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, srv := range srvs {
+		a, err := c.lookupIP(strings.TrimSuffix(srv.Target, "."), int(srv.Port))
+		if err != nil {
+			return nil, err
+		}
+		addrs = append(addrs, a...)
+	}
+	return addrs, nil
+}
+
+// lookupIP resolves the addresses of the record type of a host. Records of
+// SRV targets may be of either type.
+func (c *DNSSDConfig) lookupIP(host string, port int) ([]string, error) {
+	ips, err := lookupIP(host)
+	if err != nil {
+		return nil, err
+	}
+	var addrs []string
+	for _, ip := range ips {
+		if (c.Type == "A" && ip.To4() == nil) || (c.Type == "AAAA" && ip.To4() != nil) {
+			continue
+		}
+		addrs = append(addrs, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+	}
+	return addrs, nil
+}
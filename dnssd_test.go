@@ -0,0 +1,84 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDNSSDLookup(t *testing.T) {
+	defer func(srv func(string, string, string) (string, []*net.SRV, error), ip func(string) ([]net.IP, error)) {
+		lookupSRV, lookupIP = srv, ip
+	}(lookupSRV, lookupIP)
+	lookupSRV = func(service, proto, name string) (string, []*net.SRV, error) {
+		if name != "_memcache._tcp.cache.svc" {
+			return "", nil, fmt.Errorf("no such host")
+		}
+		return "", []*net.SRV{
+			{Target: "cache-0.cache.svc.", Port: 11211},
+			{Target: "cache-1.cache.svc.", Port: 11212},
+		}, nil
+	}
+	lookupIP = func(host string) ([]net.IP, error) {
+		switch host {
+		case "cache-0.cache.svc":
+			return []net.IP{net.ParseIP("10.0.0.1")}, nil
+		case "cache-1.cache.svc":
+			return []net.IP{net.ParseIP("10.0.0.2")}, nil
+		case "cache.svc":
+			return []net.IP{net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2"), net.ParseIP("fd00::1")}, nil
+		}
+		return nil, fmt.Errorf("no such host")
+	}
+
+	for _, test := range []struct {
+		config DNSSDConfig
+		name   string
+		want   []string
+	}{
+		{
+			config: DNSSDConfig{Names: []string{"_memcache._tcp.cache.svc"}},
+			want:   []string{"10.0.0.1:11211", "10.0.0.2:11212"},
+		},
+		{
+			config: DNSSDConfig{Names: []string{"cache.svc"}, Type: "A"},
+			want:   []string{"10.0.0.1:11211", "10.0.0.2:11211"},
+		},
+		{
+			config: DNSSDConfig{Names: []string{"cache.svc"}, Type: "AAAA", Port: 11212},
+			want:   []string{"[fd00::1]:11212"},
+		},
+	} {
+		if err := test.config.init(); err != nil {
+			t.Fatal(err)
+		}
+		have, err := test.config.lookup(test.config.Names[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(have, test.want) {
+			t.Errorf("%s %s: want %v, have %v", test.config.Type, test.config.Names[0], test.want, have)
+		}
+	}
+
+	if _, err := (&DNSSDConfig{Names: []string{"other.svc"}}).lookup("other.svc"); err == nil {
+		t.Error("want error for unknown name")
+	}
+	if err := (&DNSSDConfig{Names: []string{"cache.svc"}, Type: "MX"}).init(); err == nil {
+		t.Error("want error for unknown record type")
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// EvictionOpts configures the eviction aggregator.
+type EvictionOpts struct {
+	// Prefix extracts the prefix of an evicted key.
+	Prefix *prefixRule
+	// MaxPrefixes caps the number of exported prefixes, further prefixes are
+	// aggregated as _other.
+	MaxPrefixes int
+}
+
+// evictionAggregator breaks down the `watch evictions` stream by key prefix
+// and slab class. An eviction event looks like
+// "ts=1560000000.123456 gid=3 type=eviction key=foo fetch=no ttl=-1 la=120 clsid=1",
+// where la is the number of seconds since the last access of the item.
+type evictionAggregator struct {
+	opts EvictionOpts
+
+	mu       sync.Mutex
+	prefixes map[string]bool
+
+	evictions *prometheus.CounterVec
+	unfetched *prometheus.CounterVec
+	idle      *prometheus.HistogramVec
+}
+
+func newEvictionAggregator(opts EvictionOpts) *evictionAggregator {
+	return &evictionAggregator{
+		opts:     opts,
+		prefixes: map[string]bool{},
+		evictions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystemWatcher,
+			Name:      "evictions_total",
+			Help:      "Number of evictions seen by watch by key prefix and slab class.",
+		}, []string{"prefix", "slab"}),
+		unfetched: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystemWatcher,
+			Name:      "evictions_unfetched_total",
+			Help:      "Number of evictions seen by watch of items which were never fetched by key prefix and slab class.",
+		}, []string{"prefix", "slab"}),
+		idle: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystemWatcher,
+			Name:      "evictions_idle_seconds",
+			Help:      "Seconds since the last access of the items of the evictions seen by watch.",
+			Buckets:   ageBuckets,
+		}, []string{"prefix"}),
+	}
+}
+
+func (a *evictionAggregator) streams() []string {
+	return []string{"evictions"}
+}
+
+// prefix returns the prefix of a key, or _other once the maximum number of
+// prefixes is reached.
+func (a *evictionAggregator) prefix(key string) string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	p := a.opts.Prefix.prefix(key)
+	if !a.prefixes[p] {
+		if a.opts.MaxPrefixes > 0 && len(a.prefixes) >= a.opts.MaxPrefixes {
+			p = otherPrefix
+		}
+		a.prefixes[p] = true
+	}
+	return p
+}
+
+func (a *evictionAggregator) observe(ev watchEvent) {
+	if ev.kind != "eviction" {
+		return
+	}
+	p := a.prefix(ev.key())
+	slab := ev.fields["clsid"]
+	a.evictions.WithLabelValues(p, slab).Inc()
+	if ev.fields["fetch"] == "no" {
+		a.unfetched.WithLabelValues(p, slab).Inc()
+	}
+	if la, ok := ev.int("la"); ok {
+		a.idle.WithLabelValues(p).Observe(float64(la))
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (a *evictionAggregator) Describe(ch chan<- *prometheus.Desc) {
+	a.evictions.Describe(ch)
+	a.unfetched.Describe(ch)
+	a.idle.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (a *evictionAggregator) Collect(ch chan<- prometheus.Metric) {
+	a.evictions.Collect(ch)
+	a.unfetched.Collect(ch)
+	a.idle.Collect(ch)
+}
@@ -0,0 +1,68 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestEvictionAggregator(t *testing.T) {
+	a := newEvictionAggregator(EvictionOpts{Prefix: &prefixRule{delimiter: ":"}, MaxPrefixes: 2})
+
+	for _, line := range []string{
+		"ts=1560000000.1 gid=1 type=eviction key=user%3A1 fetch=yes ttl=-1 la=30 clsid=1",
+		"ts=1560000000.2 gid=2 type=eviction key=user%3A2 fetch=no ttl=300 la=7200 clsid=1",
+		"ts=1560000000.3 gid=3 type=eviction key=session%3A1 fetch=no ttl=60 la=10 clsid=2",
+		"ts=1560000000.4 gid=4 type=eviction key=feed%3A1 fetch=yes ttl=-1 la=100000 clsid=3",
+		"ts=1560000000.5 gid=5 type=item_get key=user%3A1 status=found clsid=1 cfd=20 size=3",
+	} {
+		ev, err := parseWatchLine(line)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a.observe(ev)
+	}
+
+	for _, c := range []struct {
+		prefix, slab       string
+		evicted, unfetched float64
+	}{
+		{"user", "1", 2, 1},
+		{"session", "2", 1, 1},
+		{"_other", "3", 1, 0},
+	} {
+		if v := counterValue(t, a.evictions.WithLabelValues(c.prefix, c.slab)); v != c.evicted {
+			t.Errorf("%s/%s: want %f evictions, have %f", c.prefix, c.slab, c.evicted, v)
+		}
+		if v := counterValue(t, a.unfetched.WithLabelValues(c.prefix, c.slab)); v != c.unfetched {
+			t.Errorf("%s/%s: want %f unfetched evictions, have %f", c.prefix, c.slab, c.unfetched, v)
+		}
+	}
+
+	var pb dto.Metric
+	if err := a.idle.WithLabelValues("user").(prometheus.Metric).Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	h := pb.GetHistogram()
+	if h.GetSampleCount() != 2 || h.GetSampleSum() != 7230 {
+		t.Errorf("unexpected idle histogram %v", h)
+	}
+	// Only the recently used item was evicted within an hour of its last access.
+	if b := h.GetBucket()[3]; b.GetUpperBound() != 3600 || b.GetCumulativeCount() != 1 {
+		t.Errorf("unexpected bucket %v", b)
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// FileSDConfig discovers the servers of a pool from files in the format of
+// Prometheus' file_sd: a list of groups of targets with common labels.
+type FileSDConfig struct {
+	// Files are paths or globs of .json, .yml or .yaml files.
+	Files []string `yaml:"files"`
+	// RefreshInterval is the time between two reads of the files, 30s by
+	// default.
+	RefreshInterval time.Duration `yaml:"refresh_interval"`
+
+	// last are the groups last read from every file.
+	last map[string][]*targetGroup
+}
+
+// init applies the defaults of a file discovery.
+func (c *FileSDConfig) init() error {
+	if len(c.Files) == 0 {
+		return fmt.Errorf("no files")
+	}
+	for _, f := range c.Files {
+		if _, err := filepath.Match(f, ""); err != nil {
+			return fmt.Errorf("invalid file pattern %q: %s", f, err)
+		}
+		switch filepath.Ext(f) {
+		case ".json", ".yml", ".yaml":
+		default:
+			return fmt.Errorf("file %q must be a .json, .yml or .yaml file", f)
+		}
+	}
+	if c.RefreshInterval < 0 {
+		return fmt.Errorf("negative refresh interval %s", c.RefreshInterval)
+	}
+	if c.RefreshInterval == 0 {
+		c.RefreshInterval = 30 * time.Second
+	}
+	return nil
+}
+
+func (c *FileSDConfig) run(ch chan<- []*targetGroup, done <-chan struct{}) {
+	for {
+		select {
+		case ch <- c.refresh():
+		case <-done:
+			return
+		}
+		select {
+		case <-time.After(c.RefreshInterval):
+		case <-done:
+			return
+		}
+	}
+}
+
+// refresh reads the files. The previous groups of a file are kept if it
+// can't be read or parsed, and removed once it doesn't exist anymore.
+func (c *FileSDConfig) refresh() []*targetGroup {
+	current := map[string][]*targetGroup{}
+	for _, pattern := range c.Files {
+		files, err := filepath.Glob(pattern)
+		if err != nil {
+			log.Errorf("Failed to list files %q: %s", pattern, err)
+			continue
+		}
+		for _, f := range files {
+			groups, err := readTargetGroups(f)
+			if err != nil {
+				log.Errorf("Failed to read targets from %s: %s", f, err)
+				groups = c.last[f]
+			}
+			current[f] = groups
+		}
+	}
+	c.last = current
+
+	var files []string
+	for f := range current {
+		files = append(files, f)
+	}
+	sort.Strings(files)
+	groups := []*targetGroup{}
+	for _, f := range files {
+		groups = append(groups, current[f]...)
+	}
+	return groups
+}
+
+// readTargetGroups parses a file_sd file by its extension. Files with invalid
+// label names are rejected like by Prometheus.
+func readTargetGroups(filename string) ([]*targetGroup, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	var groups []*targetGroup
+	if strings.HasSuffix(filename, ".json") {
+		err = json.Unmarshal(content, &groups)
+	} else {
+		err = yaml.UnmarshalStrict(content, &groups)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		if g == nil {
+			return nil, fmt.Errorf("empty target group")
+		}
+		for name := range g.Labels {
+			if !model.LabelName(name).IsValid() {
+				return nil, fmt.Errorf("invalid label name %q", name)
+			}
+		}
+	}
+	return groups, nil
+}
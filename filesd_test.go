@@ -0,0 +1,75 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFileSDRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filesd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("a.json", `[{"targets": ["10.0.0.1:11211", "10.0.0.2:11211"], "labels": {"zone": "a"}}]`)
+	write("b.yml", "- targets: ['10.0.1.1:11211']\n  labels:\n    zone: b\n")
+	write("c.txt", "ignored")
+
+	c := &FileSDConfig{Files: []string{filepath.Join(dir, "*.json"), filepath.Join(dir, "*.yml")}}
+	if err := c.init(); err != nil {
+		t.Fatal(err)
+	}
+	want := []*targetGroup{
+		{Targets: []string{"10.0.0.1:11211", "10.0.0.2:11211"}, Labels: map[string]string{"zone": "a"}},
+		{Targets: []string{"10.0.1.1:11211"}, Labels: map[string]string{"zone": "b"}},
+	}
+	if have := c.refresh(); !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+
+	// Broken files keep their previous targets.
+	write("b.yml", "- targets: [")
+	if have := c.refresh(); !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v after a broken file, have %v", want, have)
+	}
+
+	// Files with invalid label names keep their previous targets too.
+	write("b.yml", "- targets: ['10.0.1.2:11211']\n  labels:\n    cache-tier: hot\n")
+	if have := c.refresh(); !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v after an invalid label name, have %v", want, have)
+	}
+
+	// Removed files remove their targets.
+	if err := os.Remove(filepath.Join(dir, "a.json")); err != nil {
+		t.Fatal(err)
+	}
+	if have := c.refresh(); !reflect.DeepEqual(have, want[1:]) {
+		t.Errorf("want %v after removing a file, have %v", want[1:], have)
+	}
+
+	if err := (&FileSDConfig{Files: []string{"targets.txt"}}).init(); err == nil {
+		t.Error("want error for unknown file extension")
+	}
+}
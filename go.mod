@@ -8,4 +8,5 @@ require (
 	github.com/sirupsen/logrus v1.4.1 // indirect
 	golang.org/x/sys v0.0.0-20190412213103-97732733099d // indirect
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.2.2
 )
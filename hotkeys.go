@@ -0,0 +1,237 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/heap"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var hotKeyFetchesDesc = newDesc("", "hot_key_fetches", "Estimated number of fetches of the most fetched keys in the last complete window.", "key")
+
+// spaceSavingEntry is a monitored key of the Space-Saving algorithm. The true
+// count of the key is between count-err and count.
+type spaceSavingEntry struct {
+	key   string
+	count uint64
+	err   uint64
+	index int
+}
+
+// spaceSaving tracks the most frequent keys with a fixed number of counters.
+// Counters are kept in a min-heap so that the least frequent key can be
+// replaced in logarithmic time.
+type spaceSaving struct {
+	capacity int
+	entries  map[string]*spaceSavingEntry
+	heap     spaceSavingHeap
+}
+
+func newSpaceSaving(capacity int) *spaceSaving {
+	return &spaceSaving{capacity: capacity, entries: map[string]*spaceSavingEntry{}}
+}
+
+func (s *spaceSaving) add(key string) {
+	if e, ok := s.entries[key]; ok {
+		e.count++
+		heap.Fix(&s.heap, e.index)
+		return
+	}
+	if len(s.heap) < s.capacity {
+		e := &spaceSavingEntry{key: key, count: 1}
+		s.entries[key] = e
+		heap.Push(&s.heap, e)
+		return
+	}
+	// Replace the least frequent key, which inherits its count as error.
+	e := s.heap[0]
+	delete(s.entries, e.key)
+	e.key, e.err = key, e.count
+	e.count++
+	s.entries[key] = e
+	heap.Fix(&s.heap, 0)
+}
+
+// top returns the n most frequent keys, most frequent first.
+func (s *spaceSaving) top(n int) []spaceSavingEntry {
+	top := make([]spaceSavingEntry, 0, len(s.heap))
+	for _, e := range s.heap {
+		top = append(top, *e)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].count != top[j].count {
+			return top[i].count > top[j].count
+		}
+		return top[i].key < top[j].key
+	})
+	if len(top) > n {
+		top = top[:n]
+	}
+	return top
+}
+
+type spaceSavingHeap []*spaceSavingEntry
+
+func (h spaceSavingHeap) Len() int           { return len(h) }
+func (h spaceSavingHeap) Less(i, j int) bool { return h[i].count < h[j].count }
+func (h spaceSavingHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *spaceSavingHeap) Push(x interface{}) {
+	e := x.(*spaceSavingEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *spaceSavingHeap) Pop() interface{} {
+	old := *h
+	e := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return e
+}
+
+// HotKeysOpts configures the hot key aggregator.
+type HotKeysOpts struct {
+	// Top is the number of exported keys per window.
+	Top int
+	// Window is the duration over which fetches are counted.
+	Window time.Duration
+	// Prefix aggregates the keys by prefix if set.
+	Prefix *prefixRule
+}
+
+// hotKey is a key of the hot key debug page.
+type hotKey struct {
+	Key     string `json:"key"`
+	Fetches uint64 `json:"fetches"`
+	// Error is the maximum overestimation of Fetches.
+	Error uint64 `json:"error"`
+}
+
+// hotKeysWindow is the result of a complete window.
+type hotKeysWindow struct {
+	Target string    `json:"target"`
+	Start  time.Time `json:"start"`
+	End    time.Time `json:"end"`
+	Keys   []hotKey  `json:"keys"`
+}
+
+// hotKeysAggregator counts the fetches of the `watch fetchers` stream with a
+// Space-Saving sketch, which is published and reset every window.
+type hotKeysAggregator struct {
+	address string
+	opts    HotKeysOpts
+	now     func() time.Time
+
+	mu     sync.Mutex
+	sketch *spaceSaving
+	start  time.Time
+	last   *hotKeysWindow
+}
+
+func newHotKeysAggregator(address string, opts HotKeysOpts) *hotKeysAggregator {
+	a := &hotKeysAggregator{address: address, opts: opts, now: time.Now}
+	a.reset(a.now())
+	return a
+}
+
+func (a *hotKeysAggregator) reset(now time.Time) {
+	// Monitoring more keys than exported keeps the error of the top keys low.
+	a.sketch = newSpaceSaving(10 * a.opts.Top)
+	a.start = now
+}
+
+// rotate publishes the current window if it is complete. If more than one
+// window passed since the last event, the last complete window was empty.
+func (a *hotKeysAggregator) rotate() {
+	n := a.now().Sub(a.start) / a.opts.Window
+	if n < 1 {
+		return
+	}
+	end := a.start.Add(n * a.opts.Window)
+	w := &hotKeysWindow{Target: a.address, Start: end.Add(-a.opts.Window), End: end, Keys: []hotKey{}}
+	if n == 1 {
+		for _, e := range a.sketch.top(a.opts.Top) {
+			w.Keys = append(w.Keys, hotKey{Key: e.key, Fetches: e.count, Error: e.err})
+		}
+	}
+	a.last = w
+	a.reset(end)
+}
+
+func (a *hotKeysAggregator) streams() []string {
+	return []string{"fetchers"}
+}
+
+func (a *hotKeysAggregator) observe(ev watchEvent) {
+	if ev.kind != "item_get" {
+		return
+	}
+	key := ev.key()
+	if a.opts.Prefix != nil {
+		key = a.opts.Prefix.prefix(key)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rotate()
+	a.sketch.add(key)
+}
+
+// window returns the last complete window, or nil.
+func (a *hotKeysAggregator) window() *hotKeysWindow {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.rotate()
+	return a.last
+}
+
+// Describe implements prometheus.Collector.
+func (a *hotKeysAggregator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- hotKeyFetchesDesc
+}
+
+// Collect implements prometheus.Collector.
+func (a *hotKeysAggregator) Collect(ch chan<- prometheus.Metric) {
+	w := a.window()
+	if w == nil {
+		return
+	}
+	for _, k := range w.Keys {
+		ch <- prometheus.MustNewConstMetric(hotKeyFetchesDesc, prometheus.GaugeValue, float64(k.Fetches), k.Key)
+	}
+}
+
+// ServeHTTP returns the last complete window as JSON. The target parameter
+// has to be empty or the address of the watched server.
+func (a *hotKeysAggregator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if target := r.URL.Query().Get("target"); target != "" && target != a.address {
+		http.Error(w, "unknown target "+target, http.StatusNotFound)
+		return
+	}
+	win := a.window()
+	if win == nil {
+		win = &hotKeysWindow{Target: a.address, Keys: []hotKey{}}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(win)
+}
@@ -0,0 +1,100 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSpaceSaving(t *testing.T) {
+	s := newSpaceSaving(20)
+	// Two hot keys within a long tail of keys fetched once.
+	for i := 0; i < 1000; i++ {
+		if i%4 == 0 {
+			s.add("hot")
+		}
+		if i%10 == 0 {
+			s.add("warm")
+		}
+		s.add(fmt.Sprintf("cold:%d", i))
+	}
+
+	top := s.top(2)
+	if len(top) != 2 || top[0].key != "hot" || top[1].key != "warm" {
+		t.Fatalf("want hot and warm keys on top, have %+v", top)
+	}
+	for _, e := range top {
+		if e.count-e.err > 250 || e.count < 100 {
+			t.Errorf("implausible count for %+v", e)
+		}
+	}
+	if n := len(s.top(100)); n != 20 {
+		t.Errorf("want 20 monitored keys, have %d", n)
+	}
+}
+
+func TestHotKeysAggregator(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	a := newHotKeysAggregator("localhost:11211", HotKeysOpts{Top: 2, Window: time.Minute, Prefix: &prefixRule{delimiter: ":"}})
+	a.now = func() time.Time { return now }
+	a.reset(now)
+
+	get := func(key string) watchEvent {
+		return watchEvent{kind: "item_get", fields: map[string]string{"key": key}}
+	}
+	for _, k := range []string{"user:1", "user:2", "user:3", "session:1", "feed:1", "session:2"} {
+		a.observe(get(k))
+	}
+	a.observe(watchEvent{kind: "item_store", fields: map[string]string{"key": "feed:2"}})
+
+	if w := a.window(); w != nil {
+		t.Fatalf("want no complete window yet, have %+v", w)
+	}
+
+	now = now.Add(time.Minute)
+	w := a.window()
+	if w == nil || len(w.Keys) != 2 {
+		t.Fatalf("want window with 2 keys, have %+v", w)
+	}
+	if w.Keys[0] != (hotKey{Key: "user", Fetches: 3}) || w.Keys[1] != (hotKey{Key: "session", Fetches: 2}) {
+		t.Errorf("unexpected hot keys %+v", w.Keys)
+	}
+
+	rec := httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/hotkeys?target=localhost:11211", nil))
+	var have hotKeysWindow
+	if err := json.NewDecoder(rec.Body).Decode(&have); err != nil {
+		t.Fatal(err)
+	}
+	if have.Target != "localhost:11211" || len(have.Keys) != 2 || have.Keys[0].Key != "user" {
+		t.Errorf("unexpected JSON window %+v", have)
+	}
+
+	rec = httptest.NewRecorder()
+	a.ServeHTTP(rec, httptest.NewRequest("GET", "/debug/hotkeys?target=other:11211", nil))
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("want 404 for unknown target, have %d", rec.Code)
+	}
+
+	// A window without events is published empty.
+	now = now.Add(2 * time.Minute)
+	if w := a.window(); w == nil || len(w.Keys) != 0 {
+		t.Errorf("want empty window, have %+v", w)
+	}
+}
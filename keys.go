@@ -0,0 +1,55 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	keyPresentDesc = newDesc("", "key_present", "Whether the key is stored.", "key")
+	keyTTLDesc     = newDesc("", "key_ttl_seconds", "Remaining time to live of the key, -1 if it never expires.", "key")
+	keySizeDesc    = newDesc("", "key_size_bytes", "Size of the value of the key.", "key")
+)
+
+// collectKeys inspects the configured keys with `mg <key> s t u`, which
+// doesn't bump the keys in the LRU.
+func (e *Exporter) collectKeys(ch chan<- prometheus.Metric) {
+	c, err := e.opts.Dialer.meta(e.address, e.timeout)
+	if err != nil {
+		log.Errorf("Failed to connect to memcached for key checks: %s", err)
+		return
+	}
+	defer c.Close()
+
+	for _, key := range e.opts.Keys {
+		it, err := c.get(key, "s", "t", "u")
+		if err != nil {
+			log.Errorf("Failed to check key %q: %s", key, err)
+			return
+		}
+		if it == nil {
+			ch <- prometheus.MustNewConstMetric(keyPresentDesc, prometheus.GaugeValue, 0, key)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(keyPresentDesc, prometheus.GaugeValue, 1, key)
+		if ttl, ok := it.int('t'); ok {
+			ch <- prometheus.MustNewConstMetric(keyTTLDesc, prometheus.GaugeValue, float64(ttl), key)
+		}
+		if size, ok := it.int('s'); ok {
+			ch <- prometheus.MustNewConstMetric(keySizeDesc, prometheus.GaugeValue, float64(size), key)
+		}
+	}
+}
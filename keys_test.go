@@ -0,0 +1,60 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestCollectKeys(t *testing.T) {
+	s, addr := newStorageServer(t)
+	s.items["feature_flags"] = []byte("{}")
+	s.ttls["feature_flags"] = -1
+	s.items["routes"] = []byte("a,b,c")
+	s.ttls["routes"] = 300
+
+	e := NewExporter(addr, time.Second, ExporterOpts{
+		Keys:         []string{"feature_flags", "routes", "missing"},
+		DisableStats: true,
+	})
+	ch := make(chan prometheus.Metric, 100)
+	e.collectKeys(ch)
+	close(ch)
+
+	have := map[string]float64{}
+	for m := range ch {
+		k, v := metricKey(t, m)
+		have[k] = v
+	}
+	want := map[string]float64{
+		keyPresentDesc.String() + "feature_flags": 1,
+		keyTTLDesc.String() + "feature_flags":     -1,
+		keySizeDesc.String() + "feature_flags":    2,
+		keyPresentDesc.String() + "routes":        1,
+		keyTTLDesc.String() + "routes":            300,
+		keySizeDesc.String() + "routes":           5,
+		keyPresentDesc.String() + "missing":       0,
+	}
+	if len(have) != len(want) {
+		t.Errorf("want %d metrics, have %v", len(want), have)
+	}
+	for k, v := range want {
+		if have[k] != v {
+			t.Errorf("%s: want %f, have %f", k, v, have[k])
+		}
+	}
+}
@@ -0,0 +1,281 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	subsystemKeyspace = "keyspace"
+	// otherPrefix collects all keys once the maximum number of prefixes is
+	// reached.
+	otherPrefix = "_other"
+)
+
+var (
+	keyspaceItemsDesc          = newDesc(subsystemKeyspace, "items", "Number of items with this key prefix.", "prefix")
+	keyspaceBytesDesc          = newDesc(subsystemKeyspace, "bytes", "Total size of the items with this key prefix.", "prefix")
+	keyspaceFetchedItemsDesc   = newDesc(subsystemKeyspace, "fetched_items", "Number of items with this key prefix which were fetched since they were stored.", "prefix")
+	keyspaceUnfetchedItemsDesc = newDesc(subsystemKeyspace, "unfetched_items", "Number of items with this key prefix which were never fetched since they were stored.", "prefix")
+	keyspaceLastDumpDesc       = newDesc(subsystemKeyspace, "last_dump_timestamp_seconds", "Time of the last successful metadump.")
+	keyspaceDumpDurationDesc   = newDesc(subsystemKeyspace, "dump_duration_seconds", "Duration of the last successful metadump.")
+
+	// ageBuckets are the buckets of the TTL and idle time histograms, from a
+	// minute to 30 days.
+	ageBuckets = []float64{60, 300, 900, 3600, 4 * 3600, 12 * 3600, 86400, 7 * 86400, 30 * 86400}
+)
+
+// ageHistogram accumulates a histogram of ages over a metadump run. Sampled
+// items are observed with the number of items they stand for as weight.
+type ageHistogram struct {
+	counts []float64
+	count  float64
+	sum    float64
+}
+
+func newAgeHistogram() *ageHistogram {
+	return &ageHistogram{counts: make([]float64, len(ageBuckets))}
+}
+
+func (h *ageHistogram) observe(v, weight float64) {
+	for i, b := range ageBuckets {
+		if v <= b {
+			h.counts[i] += weight
+		}
+	}
+	h.count += weight
+	h.sum += v * weight
+}
+
+func (h *ageHistogram) metric(desc *prometheus.Desc, labelValues ...string) prometheus.Metric {
+	buckets := make(map[float64]uint64, len(ageBuckets))
+	for i, b := range ageBuckets {
+		buckets[b] = uint64(math.Round(h.counts[i]))
+	}
+	return prometheus.MustNewConstHistogram(desc, uint64(math.Round(h.count)), h.sum, buckets, labelValues...)
+}
+
+// ageStats are the TTL and idle time histograms of a slab class, or of all
+// classes.
+type ageStats struct {
+	ttl           *ageHistogram
+	idle          *ageHistogram
+	neverExpiring float64
+}
+
+func newAgeStats() *ageStats {
+	return &ageStats{ttl: newAgeHistogram(), idle: newAgeHistogram()}
+}
+
+// prefixRule extracts the prefix of a key. If a regexp is set, the prefix is
+// its first submatch (or the whole match without submatches). Otherwise it is
+// the part of the key before the first delimiter. Keys not matching the rule
+// have an empty prefix.
+type prefixRule struct {
+	delimiter string
+	re        *regexp.Regexp
+}
+
+func (p prefixRule) prefix(key string) string {
+	if p.re != nil {
+		m := p.re.FindStringSubmatch(key)
+		switch len(m) {
+		case 0:
+			return ""
+		case 1:
+			return m[0]
+		default:
+			return m[1]
+		}
+	}
+	if i := strings.Index(key, p.delimiter); p.delimiter != "" && i >= 0 {
+		return key[:i]
+	}
+	return ""
+}
+
+// KeyspaceOpts configures the keyspace collector.
+type KeyspaceOpts struct {
+	// Interval is the time between two metadump runs.
+	Interval time.Duration
+	// Timeout is the maximum duration of a metadump run.
+	Timeout time.Duration
+	// Prefix extracts the prefix of a key.
+	Prefix prefixRule
+	// MaxPrefixes caps the number of exported prefixes.
+	MaxPrefixes int
+	// Limit is the maximum number of items aggregated per run, 0 disables
+	// it. The items are sampled over the whole dump and the aggregation is
+	// scaled to the number of dumped items.
+	Limit int
+	// PerClass splits the TTL and idle time histograms by slab class.
+	PerClass bool
+}
+
+// prefixStats are the aggregated items of a key prefix.
+type prefixStats struct {
+	items, bytes, fetched, unfetched float64
+}
+
+// keyspaceCollector periodically runs `lru_crawler metadump all` and
+// aggregates the items by key prefix. Scrapes export the result of the last
+// successful run.
+type keyspaceCollector struct {
+	address string
+	dialer  *Dialer
+	opts    KeyspaceOpts
+	now     func() time.Time
+
+	ttlDesc           *prometheus.Desc
+	idleDesc          *prometheus.Desc
+	neverExpiringDesc *prometheus.Desc
+
+	mu       sync.Mutex
+	prefixes map[string]*prefixStats
+	ages     map[string]*ageStats
+	lastDump time.Time
+	duration time.Duration
+}
+
+func newKeyspaceCollector(address string, dialer *Dialer, opts KeyspaceOpts) *keyspaceCollector {
+	var labels []string
+	if opts.PerClass {
+		labels = []string{"slab"}
+	}
+	return &keyspaceCollector{
+		address:           address,
+		dialer:            dialer,
+		opts:              opts,
+		now:               time.Now,
+		ttlDesc:           newDesc(subsystemKeyspace, "ttl_seconds", "Remaining time to live of the items which expire.", labels...),
+		idleDesc:          newDesc(subsystemKeyspace, "idle_seconds", "Seconds since the last access of the items.", labels...),
+		neverExpiringDesc: newDesc(subsystemKeyspace, "never_expiring_items", "Number of items which never expire.", labels...),
+	}
+}
+
+// run updates the aggregation every interval. It never returns.
+func (k *keyspaceCollector) run() {
+	for {
+		if err := k.update(); err != nil {
+			log.Errorf("Failed to dump keyspace of %s: %s", k.address, err)
+		}
+		time.Sleep(k.opts.Interval)
+	}
+}
+
+// update runs a metadump and replaces the aggregation on success.
+func (k *keyspaceCollector) update() error {
+	start := k.now()
+	now := start.Unix()
+	prefixes := map[string]*prefixStats{}
+	ages := map[string]*ageStats{}
+	items, n, err := k.dialer.sampleMetadump(k.address, k.opts.Timeout, "all", k.opts.Limit)
+	if err != nil {
+		return err
+	}
+	// weight is the number of dumped items every sampled item stands for.
+	weight := float64(n) / float64(len(items))
+	for _, it := range items {
+		class := ""
+		if k.opts.PerClass {
+			class = strconv.Itoa(it.class)
+		}
+		a, ok := ages[class]
+		if !ok {
+			a = newAgeStats()
+			ages[class] = a
+		}
+		if it.exp < 0 {
+			a.neverExpiring += weight
+		} else {
+			a.ttl.observe(float64(it.exp-now), weight)
+		}
+		a.idle.observe(float64(now-it.lastAccess), weight)
+
+		p := k.opts.Prefix.prefix(it.key)
+		s, ok := prefixes[p]
+		if !ok {
+			if k.opts.MaxPrefixes > 0 && len(prefixes) >= k.opts.MaxPrefixes {
+				p = otherPrefix
+				s = prefixes[p]
+			}
+			if s == nil {
+				s = &prefixStats{}
+				prefixes[p] = s
+			}
+		}
+		s.items += weight
+		s.bytes += float64(it.size) * weight
+		if it.fetched {
+			s.fetched += weight
+		} else {
+			s.unfetched += weight
+		}
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.prefixes = prefixes
+	k.ages = ages
+	k.lastDump = k.now()
+	k.duration = k.lastDump.Sub(start)
+	return nil
+}
+
+func (k *keyspaceCollector) describe(ch chan<- *prometheus.Desc) {
+	ch <- keyspaceItemsDesc
+	ch <- keyspaceBytesDesc
+	ch <- keyspaceFetchedItemsDesc
+	ch <- keyspaceUnfetchedItemsDesc
+	ch <- keyspaceLastDumpDesc
+	ch <- keyspaceDumpDurationDesc
+	ch <- k.ttlDesc
+	ch <- k.idleDesc
+	ch <- k.neverExpiringDesc
+}
+
+func (k *keyspaceCollector) collect(ch chan<- prometheus.Metric) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	if k.lastDump.IsZero() {
+		return
+	}
+	for p, s := range k.prefixes {
+		ch <- prometheus.MustNewConstMetric(keyspaceItemsDesc, prometheus.GaugeValue, s.items, p)
+		ch <- prometheus.MustNewConstMetric(keyspaceBytesDesc, prometheus.GaugeValue, s.bytes, p)
+		ch <- prometheus.MustNewConstMetric(keyspaceFetchedItemsDesc, prometheus.GaugeValue, s.fetched, p)
+		ch <- prometheus.MustNewConstMetric(keyspaceUnfetchedItemsDesc, prometheus.GaugeValue, s.unfetched, p)
+	}
+	for class, a := range k.ages {
+		var lvs []string
+		if k.opts.PerClass {
+			lvs = []string{class}
+		}
+		ch <- a.ttl.metric(k.ttlDesc, lvs...)
+		ch <- a.idle.metric(k.idleDesc, lvs...)
+		ch <- prometheus.MustNewConstMetric(k.neverExpiringDesc, prometheus.GaugeValue, a.neverExpiring, lvs...)
+	}
+	ch <- prometheus.MustNewConstMetric(keyspaceLastDumpDesc, prometheus.GaugeValue, float64(k.lastDump.UnixNano())/1e9)
+	ch <- prometheus.MustNewConstMetric(keyspaceDumpDurationDesc, prometheus.GaugeValue, k.duration.Seconds())
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+const metadumpFixture = "key=user%3A1 exp=-1 la=1560000000 cas=1 fetch=yes cls=1 size=68\r\n" +
+	"key=user%3A2 exp=1560000600 la=1560000010 cas=2 fetch=no cls=1 size=70\r\n" +
+	"key=session%3Aabc exp=1560000300 la=1560000020 cas=3 fetch=yes cls=2 size=120\r\n" +
+	"key=flags exp=-1 la=1560000030 cas=4 fetch=no cls=1 size=60\r\n" +
+	"END\r\n"
+
+func TestPrefixRule(t *testing.T) {
+	for _, tc := range []struct {
+		rule      prefixRule
+		key, want string
+	}{
+		{prefixRule{delimiter: ":"}, "user:1", "user"},
+		{prefixRule{delimiter: ":"}, "flags", ""},
+		{prefixRule{re: regexp.MustCompile(`^([a-z]+)_`)}, "user_1", "user"},
+		{prefixRule{re: regexp.MustCompile(`^[a-z]+`)}, "user1", "user"},
+		{prefixRule{re: regexp.MustCompile(`^[a-z]+`)}, "1user", ""},
+	} {
+		if have := tc.rule.prefix(tc.key); have != tc.want {
+			t.Errorf("%q: want prefix %q, have %q", tc.key, tc.want, have)
+		}
+	}
+}
+
+func TestKeyspaceCollector(t *testing.T) {
+	addr := fakeServer(t, map[string]string{"lru_crawler metadump all": metadumpFixture})
+
+	k := newKeyspaceCollector(addr, nil, KeyspaceOpts{
+		Timeout:     time.Second,
+		Prefix:      prefixRule{delimiter: ":"},
+		MaxPrefixes: 2,
+	})
+	if err := k.update(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	k.collect(ch)
+	close(ch)
+	have := map[string]float64{}
+	for m := range ch {
+		key, v := metricKey(t, m)
+		have[key] = v
+	}
+
+	for _, tc := range []struct {
+		desc   *prometheus.Desc
+		prefix string
+		value  float64
+	}{
+		{keyspaceItemsDesc, "user", 2},
+		{keyspaceBytesDesc, "user", 138},
+		{keyspaceFetchedItemsDesc, "user", 1},
+		{keyspaceUnfetchedItemsDesc, "user", 1},
+		{keyspaceItemsDesc, "session", 1},
+		// The third prefix exceeds the maximum.
+		{keyspaceItemsDesc, otherPrefix, 1},
+		{keyspaceBytesDesc, otherPrefix, 60},
+	} {
+		if v, ok := have[tc.desc.String()+tc.prefix]; !ok || v != tc.value {
+			t.Errorf("want %s %q to be %v, have %v", tc.desc, tc.prefix, tc.value, v)
+		}
+	}
+}
+
+func TestKeyspaceAgeHistograms(t *testing.T) {
+	addr := fakeServer(t, map[string]string{"lru_crawler metadump all": metadumpFixture})
+
+	k := newKeyspaceCollector(addr, nil, KeyspaceOpts{
+		Timeout:  time.Second,
+		PerClass: true,
+	})
+	k.now = func() time.Time { return time.Unix(1560000100, 0) }
+	if err := k.update(); err != nil {
+		t.Fatal(err)
+	}
+
+	ch := make(chan prometheus.Metric, 100)
+	k.collect(ch)
+	close(ch)
+
+	histograms := map[string]*dto.Histogram{}
+	never := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		switch m.Desc() {
+		case k.ttlDesc, k.idleDesc:
+			histograms[m.Desc().String()+pb.GetLabel()[0].GetValue()] = pb.GetHistogram()
+		case k.neverExpiringDesc:
+			never[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+		}
+	}
+
+	if never["1"] != 2 || never["2"] != 0 {
+		t.Errorf("want two never expiring items in class 1, have %v", never)
+	}
+	ttl := histograms[k.ttlDesc.String()+"1"]
+	if ttl.GetSampleCount() != 1 || ttl.GetSampleSum() != 500 {
+		t.Errorf("want one TTL of 500s in class 1, have %v", ttl)
+	}
+	idle := histograms[k.idleDesc.String()+"1"]
+	if idle.GetSampleCount() != 3 || idle.GetSampleSum() != 100+90+70 {
+		t.Errorf("want idle times of 100s, 90s and 70s in class 1, have %v", idle)
+	}
+	if b := idle.GetBucket()[0]; b.GetUpperBound() != 60 || b.GetCumulativeCount() != 0 {
+		t.Errorf("want no idle time below 60s, have %v", b)
+	}
+	if b := idle.GetBucket()[1]; b.GetUpperBound() != 300 || b.GetCumulativeCount() != 3 {
+		t.Errorf("want three idle times below 300s, have %v", b)
+	}
+	ttl = histograms[k.ttlDesc.String()+"2"]
+	if ttl.GetSampleCount() != 1 || ttl.GetSampleSum() != 200 {
+		t.Errorf("want one TTL of 200s in class 2, have %v", ttl)
+	}
+}
+
+func TestKeyspaceSample(t *testing.T) {
+	addr := fakeServer(t, map[string]string{"lru_crawler metadump all": metadumpFixture})
+
+	// The sample is taken over the whole dump and scaled to all items.
+	lastSampled := false
+	for i := 0; i < 20; i++ {
+		k := newKeyspaceCollector(addr, nil, KeyspaceOpts{
+			Timeout: time.Second,
+			Prefix:  prefixRule{delimiter: ":"},
+			Limit:   2,
+		})
+		if err := k.update(); err != nil {
+			t.Fatal(err)
+		}
+		items, idle := 0., 0.
+		for _, s := range k.prefixes {
+			items += s.items
+		}
+		for _, a := range k.ages {
+			idle += a.idle.count
+		}
+		if items != 4 || idle != 4 {
+			t.Fatalf("want 4 items of the scaled sample, have %v items and %v idle times", items, idle)
+		}
+		// The last dumped item has no prefix.
+		if _, ok := k.prefixes[""]; ok {
+			lastSampled = true
+		}
+	}
+	if !lastSampled {
+		t.Error("want the last dumped item to be sampled at least once")
+	}
+}
@@ -17,7 +17,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"math"
+	"net"
 	"net/http"
+	"regexp"
 	"strconv"
 	"strings"
 	"time"
@@ -26,6 +28,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
+	"github.com/prometheus/common/model"
 	"github.com/prometheus/common/version"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
@@ -40,399 +43,145 @@ const (
 type Exporter struct {
 	address string
 	timeout time.Duration
+	opts    ExporterOpts
+
+	up                *prometheus.Desc
+	version           *prometheus.Desc
+	settingDrift      *prometheus.Desc
+	settingDriftCount *prometheus.Desc
+	statRaw           *prometheus.Desc
+	missingStats      *prometheus.CounterVec
+	restarts          *restartTracker
+	slabRecommender   *slabRecommender
+	keyspace          *keyspaceCollector
+	watcher           *watcher
+	prober            *prober
+}
 
-	up                       *prometheus.Desc
-	uptime                   *prometheus.Desc
-	version                  *prometheus.Desc
-	bytesRead                *prometheus.Desc
-	bytesWritten             *prometheus.Desc
-	currentConnections       *prometheus.Desc
-	maxConnections           *prometheus.Desc
-	connectionsTotal         *prometheus.Desc
-	connsYieldedTotal        *prometheus.Desc
-	listenerDisabledTotal    *prometheus.Desc
-	currentBytes             *prometheus.Desc
-	limitBytes               *prometheus.Desc
-	commands                 *prometheus.Desc
-	items                    *prometheus.Desc
-	itemsTotal               *prometheus.Desc
-	evictions                *prometheus.Desc
-	reclaimed                *prometheus.Desc
-	lruCrawlerEnabled        *prometheus.Desc
-	lruCrawlerSleep          *prometheus.Desc
-	lruCrawlerMaxItems       *prometheus.Desc
-	lruMaintainerThread      *prometheus.Desc
-	lruHotPercent            *prometheus.Desc
-	lruWarmPercent           *prometheus.Desc
-	lruHotMaxAgeFactor       *prometheus.Desc
-	lruWarmMaxAgeFactor      *prometheus.Desc
-	lruCrawlerStarts         *prometheus.Desc
-	lruCrawlerReclaimed      *prometheus.Desc
-	lruCrawlerItemsChecked   *prometheus.Desc
-	lruCrawlerMovesToCold    *prometheus.Desc
-	lruCrawlerMovesToWarm    *prometheus.Desc
-	lruCrawlerMovesWithinLru *prometheus.Desc
-	malloced                 *prometheus.Desc
-	itemsNumber              *prometheus.Desc
-	itemsAge                 *prometheus.Desc
-	itemsCrawlerReclaimed    *prometheus.Desc
-	itemsEvicted             *prometheus.Desc
-	itemsEvictedNonzero      *prometheus.Desc
-	itemsEvictedTime         *prometheus.Desc
-	itemsEvictedUnfetched    *prometheus.Desc
-	itemsExpiredUnfetched    *prometheus.Desc
-	itemsOutofmemory         *prometheus.Desc
-	itemsReclaimed           *prometheus.Desc
-	itemsTailrepairs         *prometheus.Desc
-	itemsMovesToCold         *prometheus.Desc
-	itemsMovesToWarm         *prometheus.Desc
-	itemsMovesWithinLru      *prometheus.Desc
-	slabsChunkSize           *prometheus.Desc
-	slabsChunksPerPage       *prometheus.Desc
-	slabsCurrentPages        *prometheus.Desc
-	slabsCurrentChunks       *prometheus.Desc
-	slabsChunksUsed          *prometheus.Desc
-	slabsChunksFree          *prometheus.Desc
-	slabsChunksFreeEnd       *prometheus.Desc
-	slabsMemRequested        *prometheus.Desc
-	slabsCommands            *prometheus.Desc
+// ExporterOpts configures the optional behaviour of an Exporter.
+type ExporterOpts struct {
+	// ExpectedSettings holds the desired value for a `stats settings` key (or
+	// limit_maxbytes). Drift detection is disabled if it is empty.
+	ExpectedSettings map[string]string
+
+	// Passthrough enables exporting all numeric stats without an explicit
+	// mapping as memcached_stat_raw.
+	Passthrough bool
+	// PassthroughAllow and PassthroughDeny restrict the passed through stats
+	// by name. A nil regexp doesn't restrict anything.
+	PassthroughAllow *regexp.Regexp
+	PassthroughDeny  *regexp.Regexp
+
+	// Derived enables exporting efficiency metrics computed from the stats.
+	Derived bool
+
+	// SlabRecommendation enables simulating slab class layouts for the item
+	// sizes reported by `stats sizes` every SlabRecommendationInterval. It
+	// has to be started with Start.
+	SlabRecommendation         bool
+	SlabRecommendationInterval time.Duration
+
+	// Keyspace enables aggregating the items of periodic metadumps by key
+	// prefix. It has to be started with Start.
+	Keyspace     bool
+	KeyspaceOpts KeyspaceOpts
+
+	// Watch enables a background `watch` connection for WatchStreams and
+	// the streams needed by WatchAggregators. It has to be started with Start.
+	Watch            bool
+	WatchStreams     []string
+	WatchAggregators []watchAggregator
+
+	// Probe enables setting, getting and deleting a canary key. With a
+	// probe interval it has to be started with Start, otherwise every scrape
+	// probes.
+	Probe     bool
+	ProbeOpts ProbeOpts
+
+	// Keys are inspected on every scrape with meta commands.
+	Keys []string
+
+	// DisableStats skips all stats commands, e.g. for cheap liveness probes.
+	// DisableSettings only skips `stats settings`.
+	DisableStats    bool
+	DisableSettings bool
+	// Dialer configures TLS and authentication if set.
+	Dialer *Dialer
 }
 
 // NewExporter returns an initialized exporter.
-func NewExporter(server string, timeout time.Duration) *Exporter {
-	return &Exporter{
+func NewExporter(server string, timeout time.Duration, opts ExporterOpts) *Exporter {
+	e := &Exporter{
 		address: server,
 		timeout: timeout,
+		opts:    opts,
 		up: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "up"),
 			"Could the memcached server be reached.",
 			nil,
 			nil,
 		),
-		uptime: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "uptime_seconds"),
-			"Number of seconds since the server started.",
-			nil,
-			nil,
-		),
 		version: prometheus.NewDesc(
 			prometheus.BuildFQName(namespace, "", "version"),
 			"The version of this memcached server.",
 			[]string{"version"},
 			nil,
 		),
-		bytesRead: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "read_bytes_total"),
-			"Total number of bytes read by this server from network.",
-			nil,
-			nil,
-		),
-		bytesWritten: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "written_bytes_total"),
-			"Total number of bytes sent by this server to network.",
-			nil,
-			nil,
-		),
-		currentConnections: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "current_connections"),
-			"Current number of open connections.",
-			nil,
-			nil,
-		),
-		maxConnections: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "max_connections"),
-			"Maximum number of clients allowed.",
-			nil,
-			nil,
-		),
-		connectionsTotal: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "connections_total"),
-			"Total number of connections opened since the server started running.",
-			nil,
-			nil,
-		),
-		connsYieldedTotal: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "connections_yielded_total"),
-			"Total number of connections yielded running due to hitting the memcached's -R limit.",
-			nil,
-			nil,
-		),
-		listenerDisabledTotal: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "connections_listener_disabled_total"),
-			"Number of times that memcached has hit its connections limit and disabled its listener.",
-			nil,
-			nil,
-		),
-		currentBytes: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "current_bytes"),
-			"Current number of bytes used to store items.",
-			nil,
+		settingDrift: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "setting_drift"),
+			"Whether a setting differs from its expected value.",
+			[]string{"name", "expected", "actual"},
 			nil,
 		),
-		limitBytes: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "limit_bytes"),
-			"Number of bytes this server is allowed to use for storage.",
+		settingDriftCount: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "setting_drift_count"),
+			"Number of settings which differ from their expected value.",
 			nil,
 			nil,
 		),
-		commands: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "commands_total"),
-			"Total number of all requests broken down by command (get, set, etc.) and status.",
-			[]string{"command", "status"},
+		statRaw: prometheus.NewDesc(
+			prometheus.BuildFQName(namespace, "", "stat_raw"),
+			"Value of a numeric stat without an explicit mapping.",
+			[]string{"name"},
 			nil,
 		),
-		items: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "current_items"),
-			"Current number of items stored by this instance.",
-			nil,
-			nil,
-		),
-		itemsTotal: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "items_total"),
-			"Total number of items stored during the life of this instance.",
-			nil,
-			nil,
-		),
-		evictions: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "items_evicted_total"),
-			"Total number of valid items removed from cache to free memory for new items.",
-			nil,
-			nil,
-		),
-		reclaimed: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "items_reclaimed_total"),
-			"Total number of times an entry was stored using memory from an expired entry.",
-			nil,
-			nil,
-		),
-		lruCrawlerEnabled: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "enabled"),
-			"Whether the LRU crawler is enabled.",
-			nil,
-			nil,
-		),
-		lruCrawlerSleep: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "sleep"),
-			"Microseconds to sleep between LRU crawls.",
-			nil,
-			nil,
-		),
-		lruCrawlerMaxItems: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "to_crawl"),
-			"Max items to crawl per slab per run.",
-			nil,
-			nil,
-		),
-		lruMaintainerThread: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "maintainer_thread"),
-			"Split LRU mode and background threads.",
-			nil,
-			nil,
-		),
-		lruHotPercent: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "hot_percent"),
-			"Percent of slab memory reserved for HOT LRU.",
-			nil,
-			nil,
-		),
-		lruWarmPercent: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "warm_percent"),
-			"Percent of slab memory reserved for WARM LRU.",
-			nil,
-			nil,
-		),
-		lruHotMaxAgeFactor: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "hot_max_factor"),
-			"Set idle age of HOT LRU to COLD age * this",
-			nil,
-			nil,
-		),
-		lruWarmMaxAgeFactor: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "warm_max_factor"),
-			"Set idle age of WARM LRU to COLD age * this",
-			nil,
-			nil,
-		),
-		lruCrawlerStarts: prometheus.NewDesc(
-			prometheus.BuildFQName("namespace", subsystemLruCrawler, "starts"),
-			"Times an LRU crawler was started.",
-			nil,
-			nil,
-		),
-		lruCrawlerReclaimed: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "reclaimed_total"),
-			"Total items freed by LRU Crawler.",
-			nil,
-			nil,
-		),
-		lruCrawlerItemsChecked: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "items_checked_total"),
-			"Total items examined by LRU Crawler.",
-			nil,
-			nil,
-		),
-		lruCrawlerMovesToCold: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "moves_to_cold_total"),
-			"Total number of items moved from HOT/WARM to COLD LRU's.",
-			nil,
-			nil,
-		),
-		lruCrawlerMovesToWarm: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "moves_to_warm_total"),
-			"Total number of items moved from COLD to WARM LRU.",
-			nil,
-			nil,
-		),
-		lruCrawlerMovesWithinLru: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemLruCrawler, "moves_within_lru_total"),
-			"Total number of items reshuffled within HOT or WARM LRU's.",
-			nil,
-			nil,
-		),
-		malloced: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, "", "malloced_bytes"),
-			"Number of bytes of memory allocated to slab pages.",
-			nil,
-			nil,
-		),
-		itemsNumber: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "current_items"),
-			"Number of items currently stored in this slab class.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsAge: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_age_seconds"),
-			"Number of seconds the oldest item has been in the slab class.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsCrawlerReclaimed: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_crawler_reclaimed_total"),
-			"Number of items freed by the LRU Crawler.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsEvicted: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_evicted_total"),
-			"Total number of times an item had to be evicted from the LRU before it expired.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsEvictedNonzero: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_evicted_nonzero_total"),
-			"Total number of times an item which had an explicit expire time set had to be evicted from the LRU before it expired.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsEvictedTime: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_evicted_time_seconds"),
-			"Seconds since the last access for the most recent item evicted from this class.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsEvictedUnfetched: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_evicted_unfetched_total"),
-			"Total nmber of items evicted and never fetched.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsExpiredUnfetched: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_expired_unfetched_total"),
-			"Total number of valid items evicted from the LRU which were never touched after being set.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsOutofmemory: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_outofmemory_total"),
-			"Total number of items for this slab class that have triggered an out of memory error.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsReclaimed: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_reclaimed_total"),
-			"Total number of items reclaimed.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsTailrepairs: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_tailrepairs_total"),
-			"Total number of times the entries for a particular ID need repairing.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsMovesToCold: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_moves_to_cold"),
-			"Number of items moved from HOT or WARM into COLD.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsMovesToWarm: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_moves_to_warm"),
-			"Number of items moves from COLD into WARM.",
-			[]string{"slab"},
-			nil,
-		),
-		itemsMovesWithinLru: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "items_moves_within_lru"),
-			"Number of times active items were bumped within HOT or WARM.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsChunkSize: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "chunk_size_bytes"),
-			"Number of bytes allocated to each chunk within this slab class.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsChunksPerPage: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "chunks_per_page"),
-			"Number of chunks within a single page for this slab class.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsCurrentPages: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "current_pages"),
-			"Number of pages allocated to this slab class.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsCurrentChunks: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "current_chunks"),
-			"Number of chunks allocated to this slab class.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsChunksUsed: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "chunks_used"),
-			"Number of chunks allocated to an item.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsChunksFree: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "chunks_free"),
-			"Number of chunks not yet allocated items.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsChunksFreeEnd: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "chunks_free_end"),
-			"Number of free chunks at the end of the last allocated page.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsMemRequested: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "mem_requested_bytes"),
-			"Number of bytes of memory actual items take up within a slab.",
-			[]string{"slab"},
-			nil,
-		),
-		slabsCommands: prometheus.NewDesc(
-			prometheus.BuildFQName(namespace, subsystemSlab, "commands_total"),
-			"Total number of all requests broken down by command (get, set, etc.) and status per slab.",
-			[]string{"slab", "command", "status"},
-			nil,
+		missingStats: prometheus.NewCounterVec(
+			prometheus.CounterOpts{
+				Namespace: namespace,
+				Subsystem: "exporter",
+				Name:      "missing_stats_total",
+				Help:      "Number of times a stat supported by the server version was missing.",
+			},
+			[]string{"key"},
 		),
+		restarts:        newRestartTracker(),
+		slabRecommender: newSlabRecommender(server, timeout, opts.SlabRecommendationInterval, opts.Dialer),
+	}
+	if opts.Keyspace {
+		e.keyspace = newKeyspaceCollector(server, opts.Dialer, opts.KeyspaceOpts)
+	}
+	if opts.Watch || len(opts.WatchAggregators) > 0 {
+		e.watcher = newWatcher(server, timeout, opts.WatchStreams, opts.WatchAggregators)
+	}
+	if opts.Probe {
+		e.prober = newProber(server, timeout, opts.Dialer, opts.ProbeOpts)
+	}
+	return e
+}
+
+// Start starts the background collectors which don't run on scrape.
+func (e *Exporter) Start() {
+	if e.opts.SlabRecommendation {
+		go e.slabRecommender.run()
+	}
+	if e.keyspace != nil {
+		go e.keyspace.run()
+	}
+	if e.watcher != nil {
+		go e.watcher.run()
+	}
+	if e.prober != nil && e.opts.ProbeOpts.Interval > 0 {
+		go e.prober.run()
 	}
 }
 
@@ -440,73 +189,77 @@ func NewExporter(server string, timeout time.Duration) *Exporter {
 // implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.up
-	ch <- e.uptime
 	ch <- e.version
-	ch <- e.bytesRead
-	ch <- e.bytesWritten
-	ch <- e.currentConnections
-	ch <- e.maxConnections
-	ch <- e.connectionsTotal
-	ch <- e.connsYieldedTotal
-	ch <- e.listenerDisabledTotal
-	ch <- e.currentBytes
-	ch <- e.limitBytes
-	ch <- e.commands
-	ch <- e.items
-	ch <- e.itemsTotal
-	ch <- e.evictions
-	ch <- e.reclaimed
-	ch <- e.lruCrawlerEnabled
-	ch <- e.lruCrawlerSleep
-	ch <- e.lruCrawlerMaxItems
-	ch <- e.lruMaintainerThread
-	ch <- e.lruHotPercent
-	ch <- e.lruWarmPercent
-	ch <- e.lruHotMaxAgeFactor
-	ch <- e.lruWarmMaxAgeFactor
-	ch <- e.lruCrawlerStarts
-	ch <- e.lruCrawlerReclaimed
-	ch <- e.lruCrawlerItemsChecked
-	ch <- e.lruCrawlerMovesToCold
-	ch <- e.lruCrawlerMovesToWarm
-	ch <- e.lruCrawlerMovesWithinLru
-	ch <- e.malloced
-	ch <- e.itemsNumber
-	ch <- e.itemsAge
-	ch <- e.itemsCrawlerReclaimed
-	ch <- e.itemsEvicted
-	ch <- e.itemsEvictedNonzero
-	ch <- e.itemsEvictedTime
-	ch <- e.itemsEvictedUnfetched
-	ch <- e.itemsExpiredUnfetched
-	ch <- e.itemsOutofmemory
-	ch <- e.itemsReclaimed
-	ch <- e.itemsTailrepairs
-	ch <- e.itemsExpiredUnfetched
-	ch <- e.itemsMovesToCold
-	ch <- e.itemsMovesToWarm
-	ch <- e.itemsMovesWithinLru
-	ch <- e.slabsChunkSize
-	ch <- e.slabsChunksPerPage
-	ch <- e.slabsCurrentPages
-	ch <- e.slabsCurrentChunks
-	ch <- e.slabsChunksUsed
-	ch <- e.slabsChunksFree
-	ch <- e.slabsChunksFreeEnd
-	ch <- e.slabsMemRequested
-	ch <- e.slabsCommands
+	describeMappings(ch)
+	ch <- e.settingDrift
+	ch <- e.settingDriftCount
+	ch <- e.statRaw
+	if e.opts.Derived {
+		for _, d := range derivedDescs {
+			ch <- d
+		}
+	}
+	if e.opts.SlabRecommendation {
+		ch <- slabLayoutWasteDesc
+	}
+	if e.keyspace != nil {
+		e.keyspace.describe(ch)
+	}
+	if e.watcher != nil {
+		e.watcher.Describe(ch)
+	}
+	if e.prober != nil {
+		e.prober.describe(ch)
+	}
+	if len(e.opts.Keys) > 0 {
+		ch <- keyPresentDesc
+		ch <- keyTTLDesc
+		ch <- keySizeDesc
+	}
+	e.missingStats.Describe(ch)
+	e.restarts.describe(ch)
 }
 
 // Collect fetches the statistics from the configured memcached server, and
 // delivers them as Prometheus metrics. It implements prometheus.Collector.
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
-	c, err := memcache.New(e.address)
+	defer e.restarts.collect(ch)
+	if e.keyspace != nil {
+		defer e.keyspace.collect(ch)
+	}
+	if e.watcher != nil {
+		defer e.watcher.Collect(ch)
+	}
+	if e.prober != nil {
+		if e.opts.ProbeOpts.Interval == 0 {
+			e.prober.probe()
+		}
+		defer e.prober.collect(ch)
+	}
+	if len(e.opts.Keys) > 0 {
+		e.collectKeys(ch)
+	}
+	defer e.missingStats.Collect(ch)
+
+	if e.opts.DisableStats {
+		// Only check that the server can be reached.
+		up := 0.
+		if conn, err := e.opts.Dialer.dial(e.address, e.timeout); err != nil {
+			log.Errorf("Failed to connect to memcached: %s", err)
+		} else {
+			conn.Close()
+			up = 1
+		}
+		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, up)
+		return
+	}
+
+	c, err := e.client()
 	if err != nil {
 		ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 0)
 		log.Errorf("Failed to connect to memcached: %s", err)
 		return
 	}
-	c.Timeout = e.timeout
 
 	stats, err := c.Stats()
 	if err != nil {
@@ -516,130 +269,99 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	}
 	ch <- prometheus.MustNewConstMetric(e.up, prometheus.GaugeValue, 1)
 
-	// TODO(ts): Clean up and consolidate metric mappings.
-	itemsMetrics := map[string]*prometheus.Desc{
-		"crawler_reclaimed": e.itemsCrawlerReclaimed,
-		"evicted":           e.itemsEvicted,
-		"evicted_nonzero":   e.itemsEvictedNonzero,
-		"evicted_time":      e.itemsEvictedTime,
-		"evicted_unfetched": e.itemsEvictedUnfetched,
-		"expired_unfetched": e.itemsExpiredUnfetched,
-		"outofmemory":       e.itemsOutofmemory,
-		"reclaimed":         e.itemsReclaimed,
-		"tailrepairs":       e.itemsTailrepairs,
-		"moves_to_cold":     e.itemsMovesToCold,
-		"moves_to_warm":     e.itemsMovesToWarm,
-		"moves_within_lru":  e.itemsMovesWithinLru,
-	}
-
-	for _, t := range stats {
-		s := t.Stats
-		ch <- prometheus.MustNewConstMetric(e.uptime, prometheus.CounterValue, parse(s, "uptime"))
-		ch <- prometheus.MustNewConstMetric(e.version, prometheus.GaugeValue, 1, s["version"])
-
-		for _, op := range []string{"get", "delete", "incr", "decr", "cas", "touch"} {
-			ch <- prometheus.MustNewConstMetric(e.commands, prometheus.CounterValue, parse(s, op+"_hits"), op, "hit")
-			ch <- prometheus.MustNewConstMetric(e.commands, prometheus.CounterValue, parse(s, op+"_misses"), op, "miss")
-		}
-		ch <- prometheus.MustNewConstMetric(e.commands, prometheus.CounterValue, parse(s, "cas_badval"), "cas", "badval")
-		ch <- prometheus.MustNewConstMetric(e.commands, prometheus.CounterValue, parse(s, "cmd_flush"), "flush", "hit")
-
-		// memcached includes cas operations again in cmd_set.
-		set := math.NaN()
-		if setCmd, err := strconv.ParseFloat(s["cmd_set"], 64); err == nil {
-			if cas, casErr := sum(s, "cas_misses", "cas_hits", "cas_badval"); casErr == nil {
-				set = setCmd - cas
-			} else {
-				log.Errorf("Failed to parse cas: %s", casErr)
-			}
-		} else {
-			log.Errorf("Failed to parse set %q: %s", s["cmd_set"], err)
-		}
-		ch <- prometheus.MustNewConstMetric(e.commands, prometheus.CounterValue, set, "set", "hit")
-
-		ch <- prometheus.MustNewConstMetric(e.currentBytes, prometheus.GaugeValue, parse(s, "bytes"))
-		ch <- prometheus.MustNewConstMetric(e.limitBytes, prometheus.GaugeValue, parse(s, "limit_maxbytes"))
-		ch <- prometheus.MustNewConstMetric(e.items, prometheus.GaugeValue, parse(s, "curr_items"))
-		ch <- prometheus.MustNewConstMetric(e.itemsTotal, prometheus.CounterValue, parse(s, "total_items"))
-
-		ch <- prometheus.MustNewConstMetric(e.bytesRead, prometheus.CounterValue, parse(s, "bytes_read"))
-		ch <- prometheus.MustNewConstMetric(e.bytesWritten, prometheus.CounterValue, parse(s, "bytes_written"))
-
-		ch <- prometheus.MustNewConstMetric(e.currentConnections, prometheus.GaugeValue, parse(s, "curr_connections"))
-		ch <- prometheus.MustNewConstMetric(e.connectionsTotal, prometheus.CounterValue, parse(s, "total_connections"))
-		ch <- prometheus.MustNewConstMetric(e.connsYieldedTotal, prometheus.CounterValue, parse(s, "conn_yields"))
-		ch <- prometheus.MustNewConstMetric(e.listenerDisabledTotal, prometheus.CounterValue, parse(s, "listen_disabled_num"))
-
-		ch <- prometheus.MustNewConstMetric(e.evictions, prometheus.CounterValue, parse(s, "evictions"))
-		ch <- prometheus.MustNewConstMetric(e.reclaimed, prometheus.CounterValue, parse(s, "reclaimed"))
-
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerStarts, prometheus.UntypedValue, parse(s, "lru_crawler_starts"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerItemsChecked, prometheus.CounterValue, parse(s, "crawler_items_checked"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerReclaimed, prometheus.CounterValue, parse(s, "crawler_reclaimed"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerMovesToCold, prometheus.CounterValue, parse(s, "moves_to_cold"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerMovesToWarm, prometheus.CounterValue, parse(s, "moves_to_warm"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerMovesWithinLru, prometheus.CounterValue, parse(s, "moves_within_lru"))
-
-		ch <- prometheus.MustNewConstMetric(e.malloced, prometheus.GaugeValue, parse(s, "total_malloced"))
-
-		for slab, u := range t.Items {
-			slab := strconv.Itoa(slab)
-			ch <- prometheus.MustNewConstMetric(e.itemsNumber, prometheus.GaugeValue, parse(u, "number"), slab)
-			ch <- prometheus.MustNewConstMetric(e.itemsAge, prometheus.GaugeValue, parse(u, "age"), slab)
-			for m, d := range itemsMetrics {
-				if _, ok := u[m]; !ok {
-					continue
-				}
-				ch <- prometheus.MustNewConstMetric(d, prometheus.CounterValue, parse(u, m), slab)
-			}
-		}
+	for addr, t := range stats {
+		e.restarts.observe(addr.String(), t.Stats)
+		e.collectStats(ch, t.Stats, t.Items, t.Slabs)
+	}
+	if e.opts.SlabRecommendation {
+		e.slabRecommender.collect(ch)
+	}
 
-		for slab, v := range t.Slabs {
-			slab := strconv.Itoa(slab)
+	if e.opts.DisableSettings {
+		return
+	}
+	statsSettings, err := c.StatsSettings()
+	if err != nil {
+		log.Errorf("Could not query stats settings: %s", err)
+	}
+	for addr, settings := range statsSettings {
+		e.collectMappings(ch, sourceSettings, serverVersion(stats[addr].Stats), settings)
 
-			for _, op := range []string{"get", "delete", "incr", "decr", "cas", "touch"} {
-				ch <- prometheus.MustNewConstMetric(e.slabsCommands, prometheus.CounterValue, parse(v, op+"_hits"), slab, op, "hit")
-			}
-			ch <- prometheus.MustNewConstMetric(e.slabsCommands, prometheus.CounterValue, parse(v, "cas_badval"), slab, "cas", "badval")
-
-			slabSet := math.NaN()
-			if slabSetCmd, err := strconv.ParseFloat(v["cmd_set"], 64); err == nil {
-				if slabCas, slabCasErr := sum(v, "cas_hits", "cas_badval"); slabCasErr == nil {
-					slabSet = slabSetCmd - slabCas
-				} else {
-					log.Errorf("Failed to parse cas: %s", slabCasErr)
-				}
-			} else {
-				log.Errorf("Failed to parse set %q: %s", v["cmd_set"], err)
-			}
-			ch <- prometheus.MustNewConstMetric(e.slabsCommands, prometheus.CounterValue, slabSet, slab, "set", "hit")
-
-			ch <- prometheus.MustNewConstMetric(e.slabsChunkSize, prometheus.GaugeValue, parse(v, "chunk_size"), slab)
-			ch <- prometheus.MustNewConstMetric(e.slabsChunksPerPage, prometheus.GaugeValue, parse(v, "chunks_per_page"), slab)
-			ch <- prometheus.MustNewConstMetric(e.slabsCurrentPages, prometheus.GaugeValue, parse(v, "total_pages"), slab)
-			ch <- prometheus.MustNewConstMetric(e.slabsCurrentChunks, prometheus.GaugeValue, parse(v, "total_chunks"), slab)
-			ch <- prometheus.MustNewConstMetric(e.slabsChunksUsed, prometheus.GaugeValue, parse(v, "used_chunks"), slab)
-			ch <- prometheus.MustNewConstMetric(e.slabsChunksFree, prometheus.GaugeValue, parse(v, "free_chunks"), slab)
-			ch <- prometheus.MustNewConstMetric(e.slabsChunksFreeEnd, prometheus.GaugeValue, parse(v, "free_chunks_end"), slab)
-			ch <- prometheus.MustNewConstMetric(e.slabsMemRequested, prometheus.GaugeValue, parse(v, "mem_requested"), slab)
+		if len(e.opts.ExpectedSettings) > 0 {
+			e.collectDrift(ch, settings, stats[addr].Stats)
 		}
 	}
+}
 
-	statsSettings, err := c.StatsSettings()
+// statsClient fetches the stats of the servers. It is implemented by the
+// memcache client and by dialerClient.
+type statsClient interface {
+	Stats() (map[net.Addr]memcache.Stats, error)
+	StatsSettings() (map[net.Addr]map[string]string, error)
+}
+
+// client returns the memcache client, or a dialerClient if the connections
+// need TLS or authentication.
+func (e *Exporter) client() (statsClient, error) {
+	if e.opts.Dialer != nil {
+		return &dialerClient{dialer: e.opts.Dialer, address: e.address, timeout: e.timeout}, nil
+	}
+	c, err := memcache.New(e.address)
 	if err != nil {
-		log.Errorf("Could not query stats settings: %s", err)
+		return nil, err
 	}
-	for _, settings := range statsSettings {
-		ch <- prometheus.MustNewConstMetric(e.maxConnections, prometheus.GaugeValue, parse(settings, "maxconns"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerEnabled, prometheus.GaugeValue, parseBool(settings, "lru_crawler"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerSleep, prometheus.GaugeValue, parse(settings, "lru_crawler_sleep"))
-		ch <- prometheus.MustNewConstMetric(e.lruCrawlerMaxItems, prometheus.GaugeValue, parse(settings, "lru_crawler_tocrawl"))
-		ch <- prometheus.MustNewConstMetric(e.lruMaintainerThread, prometheus.GaugeValue, parseBool(settings, "lru_maintainer_thread"))
-		ch <- prometheus.MustNewConstMetric(e.lruHotPercent, prometheus.GaugeValue, parse(settings, "hot_lru_pct"))
-		ch <- prometheus.MustNewConstMetric(e.lruWarmPercent, prometheus.GaugeValue, parse(settings, "warm_lru_pct"))
-		ch <- prometheus.MustNewConstMetric(e.lruHotMaxAgeFactor, prometheus.GaugeValue, parse(settings, "hot_max_factor"))
-		ch <- prometheus.MustNewConstMetric(e.lruWarmMaxAgeFactor, prometheus.GaugeValue, parse(settings, "warm_max_factor"))
+	c.Timeout = e.timeout
+	return c, nil
+}
+
+// collectStats exports the general and the per slab class stats of a server.
+func (e *Exporter) collectStats(ch chan<- prometheus.Metric, stats map[string]string, items, slabs map[int]map[string]string) {
+	ch <- prometheus.MustNewConstMetric(e.version, prometheus.GaugeValue, 1, stats["version"])
+	version := serverVersion(stats)
+	e.collectMappings(ch, sourceStats, version, stats)
+
+	if e.opts.Passthrough {
+		e.collectPassthrough(ch, stats)
+	}
+	if e.opts.Derived {
+		collectDerived(ch, stats, slabs)
+	}
+
+	for slab, u := range items {
+		e.collectMappings(ch, sourceItems, version, u, strconv.Itoa(slab))
+	}
+	for slab, v := range slabs {
+		e.collectMappings(ch, sourceSlabs, version, v, strconv.Itoa(slab))
+	}
+}
+
+// serverVersion returns the parsed version stat. If it can't be parsed, the
+// zero version is returned and all metrics are exported.
+func serverVersion(stats map[string]string) semver {
+	v, err := parseSemver(stats["version"])
+	if err != nil {
+		log.Debugf("Failed to parse server version: %s", err)
 	}
+	return v
+}
+
+// collectDrift compares the expected settings against the reported settings
+// and exports a series for every mismatch. limit_maxbytes is not part of
+// `stats settings` and is looked up in the general stats instead.
+func (e *Exporter) collectDrift(ch chan<- prometheus.Metric, settings, stats map[string]string) {
+	drifted := 0
+	for name, expected := range e.opts.ExpectedSettings {
+		actual, ok := settings[name]
+		if !ok {
+			actual = stats[name]
+		}
+		if settingEqual(expected, actual) {
+			continue
+		}
+		drifted++
+		ch <- prometheus.MustNewConstMetric(e.settingDrift, prometheus.GaugeValue, 1, name, expected, actual)
+	}
+	ch <- prometheus.MustNewConstMetric(e.settingDriftCount, prometheus.GaugeValue, float64(drifted))
 }
 
 func parse(stats map[string]string, key string) float64 {
@@ -663,6 +385,56 @@ func parseBool(stats map[string]string, key string) float64 {
 	}
 }
 
+// mappedStats are the general stats with an explicit mapping. They are never
+// exported by the passthrough.
+var mappedStats = func() map[string]bool {
+	m := map[string]bool{"version": true}
+	for _, sm := range statMappings {
+		if sm.source == sourceStats {
+			m[sm.key] = true
+		}
+	}
+	return m
+}()
+
+// collectPassthrough exports every numeric general stat which has no explicit
+// mapping and passes the allow and deny filters.
+func (e *Exporter) collectPassthrough(ch chan<- prometheus.Metric, stats map[string]string) {
+	for name, value := range stats {
+		if mappedStats[name] {
+			continue
+		}
+		if e.opts.PassthroughAllow != nil && !e.opts.PassthroughAllow.MatchString(name) {
+			continue
+		}
+		if e.opts.PassthroughDeny != nil && e.opts.PassthroughDeny.MatchString(name) {
+			continue
+		}
+		v, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(e.statRaw, prometheus.UntypedValue, v, name)
+	}
+}
+
+// settingEqual compares two setting values numerically if both are numbers, so
+// that "1.25" and "1.250" are considered equal, and literally otherwise.
+func settingEqual(expected, actual string) bool {
+	if expected == actual {
+		return true
+	}
+	e, err := strconv.ParseFloat(expected, 64)
+	if err != nil {
+		return false
+	}
+	a, err := strconv.ParseFloat(actual, 64)
+	if err != nil {
+		return false
+	}
+	return e == a
+}
+
 func sum(stats map[string]string, keys ...string) (float64, error) {
 	s := 0.
 	for _, key := range keys {
@@ -675,12 +447,61 @@ func sum(stats map[string]string, keys ...string) (float64, error) {
 	return s, nil
 }
 
+// compileAnchored compiles a regexp which has to match the whole string. An
+// empty expression results in a nil regexp.
+func compileAnchored(expr string) (*regexp.Regexp, error) {
+	if expr == "" {
+		return nil, nil
+	}
+	return regexp.Compile("^(?:" + expr + ")$")
+}
+
 func main() {
 	var (
 		address       = kingpin.Flag("memcached.address", "Memcached server address.").Default("localhost:11211").String()
 		timeout       = kingpin.Flag("memcached.timeout", "memcached connect timeout.").Default("1s").Duration()
 		pidFile       = kingpin.Flag("memcached.pid-file", "Optional path to a file containing the memcached PID for additional metrics.").Default("").String()
 		unixSocket    = kingpin.Flag("memcached.unix-socket", "Optional path to the unix socket file.").Default("").String()
+		expected      = kingpin.Flag("memcached.expected-setting", "Expected value of a memcached setting, as name=value. Mismatches are exported as drift. May be repeated.").StringMap()
+		passthrough   = kingpin.Flag("collector.general.passthrough", "Export numeric stats without an explicit mapping as memcached_stat_raw.").Default("false").Bool()
+		passAllow     = kingpin.Flag("collector.general.passthrough.allow", "Regexp of stat names to pass through.").Default(".*").String()
+		passDeny      = kingpin.Flag("collector.general.passthrough.deny", "Regexp of stat names to never pass through.").Default("").String()
+		derived       = kingpin.Flag("collector.derived", "Export efficiency metrics derived from the stats.").Default("false").Bool()
+		keyspace      = kingpin.Flag("collector.keyspace", "Periodically run lru_crawler metadump and aggregate the items by key prefix.").Default("false").Bool()
+		ksInterval    = kingpin.Flag("collector.keyspace.interval", "Interval between two metadumps.").Default("5m").Duration()
+		ksTimeout     = kingpin.Flag("collector.keyspace.timeout", "Maximum duration of a metadump.").Default("1m").Duration()
+		ksDelimiter   = kingpin.Flag("collector.keyspace.delimiter", "The key prefix is the part of the key before this delimiter.").Default(":").String()
+		ksPrefixRe    = kingpin.Flag("collector.keyspace.prefix-regexp", "Regexp extracting the key prefix as first submatch. Overrides the delimiter.").Default("").String()
+		ksMaxPrefixes = kingpin.Flag("collector.keyspace.max-prefixes", "Maximum number of exported key prefixes, further prefixes are aggregated as _other.").Default("100").Int()
+		ksLimit       = kingpin.Flag("collector.keyspace.limit", "Maximum number of items sampled over a metadump and scaled to all items, 0 for all items.").Default("0").Int()
+		ksPerClass    = kingpin.Flag("collector.keyspace.per-class", "Split the TTL and idle time histograms by slab class.").Default("false").Bool()
+		watch         = kingpin.Flag("collector.watch", "Keep a watch connection open and count the logged events.").Default("false").Bool()
+		watchStreams  = kingpin.Flag("collector.watch.streams", "Comma separated watch streams, e.g. fetchers,mutations,evictions,connevents.").Default("fetchers,mutations,evictions,connevents").String()
+		hotKeys       = kingpin.Flag("collector.watch.hotkeys", "Track the most fetched keys of the watch fetchers stream.").Default("false").Bool()
+		hotKeysTop    = kingpin.Flag("collector.watch.hotkeys.top", "Number of hot keys exported per window.").Default("10").Int()
+		hotKeysWindow = kingpin.Flag("collector.watch.hotkeys.window", "Duration of a hot key window.").Default("1m").Duration()
+		hotKeysPrefix = kingpin.Flag("collector.watch.hotkeys.prefixes", "Track key prefixes, as configured for the keyspace collector, instead of keys.").Default("false").Bool()
+		mrc           = kingpin.Flag("collector.watch.mrc", "Estimate the hit ratio of hypothetical cache sizes from the watch fetchers and mutations streams.").Default("false").Bool()
+		mrcSizes      = kingpin.Flag("collector.watch.mrc.sizes", "Comma separated cache sizes to estimate the hit ratio for, e.g. 512MB,1GB,2GB.").Default("64MB,128MB,256MB,512MB,1GB,2GB,4GB").String()
+		mrcSampleRate = kingpin.Flag("collector.watch.mrc.sample-rate", "Fraction of the keys which are simulated.").Default("0.01").Float64()
+		mrcMaxKeys    = kingpin.Flag("collector.watch.mrc.max-keys", "Maximum number of simulated keys.").Default("100000").Int()
+		uniqueKeys    = kingpin.Flag("collector.watch.unique-keys", "Estimate the distinct keys fetched and written from the watch fetchers and mutations streams.").Default("false").Bool()
+		ukWindows     = kingpin.Flag("collector.watch.unique-keys.windows", "Comma separated durations of the rolling windows.").Default("1m,1h").String()
+		ukPrefix      = kingpin.Flag("collector.watch.unique-keys.prefixes", "Also estimate the distinct keys per key prefix, as configured for the keyspace collector.").Default("false").Bool()
+		evictions     = kingpin.Flag("collector.watch.evictions", "Break down the watch evictions stream by key prefix, as configured for the keyspace collector, and slab class.").Default("false").Bool()
+		connEvents    = kingpin.Flag("collector.watch.connections", "Track connection lifetimes and close reasons of the watch connevents stream by client address.").Default("false").Bool()
+		connIPv4Mask  = kingpin.Flag("collector.watch.connections.ipv4-mask", "Prefix length IPv4 client addresses are grouped by.").Default("24").Int()
+		connIPv6Mask  = kingpin.Flag("collector.watch.connections.ipv6-mask", "Prefix length IPv6 client addresses are grouped by.").Default("64").Int()
+		connClients   = kingpin.Flag("collector.watch.connections.max-clients", "Maximum number of exported client address buckets, further clients are aggregated as _other.").Default("100").Int()
+		keys          = kingpin.Flag("collector.key", "Key to check for presence, TTL and size on every scrape. May be repeated.").Strings()
+		probe         = kingpin.Flag("collector.probe", "Set, get and delete a canary key and export the latency.").Default("false").Bool()
+		probeOp       = kingpin.Flag("collector.probe.op", "Probe commands: set_get, meta (set, get and delete with meta commands) or noop (meta no-op).").Default("set_get").Enum(probeSetGet, probeMeta, probeNoop)
+		probeKey      = kingpin.Flag("collector.probe.key", "Canary key of the probe.").Default("memcached_exporter_probe").String()
+		probeTTL      = kingpin.Flag("collector.probe.ttl", "Expiration time of the canary key.").Default("1m").Duration()
+		probeInterval = kingpin.Flag("collector.probe.interval", "Interval between two probes, 0 to probe on every scrape.").Default("0s").Duration()
+		slabLayout    = kingpin.Flag("collector.slab-recommendation", "Periodically simulate slab class layouts for the item sizes of `stats sizes` and recommend -f and -n values.").Default("false").Bool()
+		slabInterval  = kingpin.Flag("collector.slab-recommendation.interval", "Interval between two slab layout simulations.").Default("5m").Duration()
+		configFile    = kingpin.Flag("config.file", "Configuration file defining the modules of /probe.").Default("").String()
 		listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9150").String()
 		metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
 	)
@@ -696,7 +517,134 @@ func main() {
 		fmt.Printf("socket set\n")
 	}
 
-	prometheus.MustRegister(NewExporter(*address, *timeout))
+	opts := ExporterOpts{
+		ExpectedSettings:   *expected,
+		Passthrough:        *passthrough,
+		Derived:            *derived,
+		SlabRecommendation: *slabLayout,
+		Keyspace:           *keyspace,
+		Keys:               *keys,
+		Probe:              *probe,
+		ProbeOpts: ProbeOpts{
+			Op:       *probeOp,
+			Key:      *probeKey,
+			TTL:      *probeTTL,
+			Interval: *probeInterval,
+		},
+		KeyspaceOpts: KeyspaceOpts{
+			Interval:    *ksInterval,
+			Timeout:     *ksTimeout,
+			Prefix:      prefixRule{delimiter: *ksDelimiter},
+			MaxPrefixes: *ksMaxPrefixes,
+			Limit:       *ksLimit,
+			PerClass:    *ksPerClass,
+		},
+	}
+	if *watch {
+		opts.Watch = true
+		opts.WatchStreams = strings.Split(*watchStreams, ",")
+	}
+	if *keyspace && *ksInterval <= 0 {
+		log.Fatalf("Invalid keyspace interval %s", *ksInterval)
+	}
+	if *slabLayout {
+		if *slabInterval <= 0 {
+			log.Fatalf("Invalid slab recommendation interval %s", *slabInterval)
+		}
+		opts.SlabRecommendationInterval = *slabInterval
+	}
+	var hotKeysAggregator *hotKeysAggregator
+	if *hotKeys {
+		if *hotKeysTop < 1 {
+			log.Fatalf("Invalid number of hot keys %d", *hotKeysTop)
+		}
+		if *hotKeysWindow <= 0 {
+			log.Fatalf("Invalid hot keys window %s", *hotKeysWindow)
+		}
+		hkOpts := HotKeysOpts{Top: *hotKeysTop, Window: *hotKeysWindow}
+		if *hotKeysPrefix {
+			hkOpts.Prefix = &opts.KeyspaceOpts.Prefix
+		}
+		hotKeysAggregator = newHotKeysAggregator(*address, hkOpts)
+		opts.WatchAggregators = append(opts.WatchAggregators, hotKeysAggregator)
+	}
+	if *mrc {
+		sizes, err := parseByteSizes(*mrcSizes)
+		if err != nil {
+			log.Fatalf("Invalid miss ratio curve sizes: %s", err)
+		}
+		if *mrcSampleRate <= 0 || *mrcSampleRate > 1 {
+			log.Fatalf("Invalid miss ratio curve sample rate %g", *mrcSampleRate)
+		}
+		opts.WatchAggregators = append(opts.WatchAggregators, newMRCAggregator(MRCOpts{
+			SampleRate: *mrcSampleRate,
+			MaxKeys:    *mrcMaxKeys,
+			Sizes:      sizes,
+		}))
+	}
+	if *uniqueKeys {
+		ukOpts := UniqueKeysOpts{MaxPrefixes: *ksMaxPrefixes}
+		seen := map[time.Duration]bool{}
+		for _, w := range strings.Split(*ukWindows, ",") {
+			d, err := model.ParseDuration(strings.TrimSpace(w))
+			if err != nil {
+				log.Fatalf("Invalid unique keys window: %s", err)
+			}
+			// Every slot of a window must be at least a nanosecond.
+			if time.Duration(d) < hllSlots {
+				log.Fatalf("Invalid unique keys window %s", d)
+			}
+			// Equal windows like 1m and 60s would export the same series.
+			if seen[time.Duration(d)] {
+				continue
+			}
+			seen[time.Duration(d)] = true
+			ukOpts.Windows = append(ukOpts.Windows, time.Duration(d))
+		}
+		if *ukPrefix {
+			ukOpts.Prefix = &opts.KeyspaceOpts.Prefix
+		}
+		opts.WatchAggregators = append(opts.WatchAggregators, newUniqueKeysAggregator(ukOpts))
+	}
+	if *evictions {
+		opts.WatchAggregators = append(opts.WatchAggregators, newEvictionAggregator(EvictionOpts{
+			Prefix:      &opts.KeyspaceOpts.Prefix,
+			MaxPrefixes: *ksMaxPrefixes,
+		}))
+	}
+	if *connEvents {
+		if *connIPv4Mask < 0 || *connIPv4Mask > 32 {
+			log.Fatalf("Invalid IPv4 mask %d", *connIPv4Mask)
+		}
+		if *connIPv6Mask < 0 || *connIPv6Mask > 128 {
+			log.Fatalf("Invalid IPv6 mask %d", *connIPv6Mask)
+		}
+		opts.WatchAggregators = append(opts.WatchAggregators, newConnEventsAggregator(ConnEventsOpts{
+			IPv4Mask:   *connIPv4Mask,
+			IPv6Mask:   *connIPv6Mask,
+			MaxClients: *connClients,
+		}))
+	}
+	if *ksPrefixRe != "" {
+		re, err := regexp.Compile(*ksPrefixRe)
+		if err != nil {
+			log.Fatalf("Invalid keyspace prefix regexp: %s", err)
+		}
+		opts.KeyspaceOpts.Prefix.re = re
+	}
+	if *passthrough {
+		var err error
+		if opts.PassthroughAllow, err = compileAnchored(*passAllow); err != nil {
+			log.Fatalf("Invalid passthrough allow regexp: %s", err)
+		}
+		if opts.PassthroughDeny, err = compileAnchored(*passDeny); err != nil {
+			log.Fatalf("Invalid passthrough deny regexp: %s", err)
+		}
+	}
+
+	exporter := NewExporter(*address, *timeout, opts)
+	exporter.Start()
+	prometheus.MustRegister(exporter)
 	if *pidFile != "" {
 		procExporter := prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{
 			PidFn: func() (int, error) {
@@ -715,7 +663,58 @@ func main() {
 		prometheus.MustRegister(procExporter)
 	}
 
-	http.Handle(*metricsPath, promhttp.Handler())
+	cfg, err := parseConfig(nil)
+	if *configFile != "" {
+		cfg, err = loadConfig(*configFile)
+	}
+	if err != nil {
+		log.Fatalf("Error loading config file: %s", err)
+	}
+	scraper := newTargetScraper(cfg.Modules)
+	for _, p := range cfg.Pools {
+		p.discover(scraper.sync, nil)
+	}
+	var checkedPools []*Pool
+	for _, p := range cfg.Pools {
+		if p.Consistency != nil {
+			checkedPools = append(checkedPools, p)
+		}
+	}
+	if len(checkedPools) > 0 {
+		checker := newReplicaChecker(checkedPools)
+		checker.run()
+		prometheus.MustRegister(checker)
+	}
+	var shardedPools, aggregatedPools []*Pool
+	for _, p := range cfg.Pools {
+		if p.Hash != "" {
+			shardedPools = append(shardedPools, p)
+		}
+		if p.Aggregate {
+			aggregatedPools = append(aggregatedPools, p)
+		}
+	}
+	if len(shardedPools) > 0 {
+		analyzer := newRingAnalyzer(shardedPools, *timeout)
+		go analyzer.run()
+		prometheus.MustRegister(analyzer)
+	}
+	if len(aggregatedPools) > 0 {
+		prometheus.MustRegister(newPoolAggregator(aggregatedPools, *timeout))
+	}
+
+	// Discovered servers are exported with the exporter's own metrics.
+	http.Handle(*metricsPath, promhttp.InstrumentMetricHandler(
+		prometheus.DefaultRegisterer,
+		promhttp.HandlerFor(prometheus.Gatherers{prometheus.DefaultGatherer, scraper}, promhttp.HandlerOpts{}),
+	))
+	http.Handle("/probe", probeHandler(cfg))
+	if *slabLayout {
+		http.Handle("/debug/slab-recommendation", exporter.slabRecommender)
+	}
+	if hotKeysAggregator != nil {
+		http.Handle("/debug/hotkeys", hotKeysAggregator)
+	}
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
              <head><title>Memcached Exporter</title></head>
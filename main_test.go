@@ -20,11 +20,14 @@ import (
 	"net/http"
 	"os"
 	"os/exec"
+	"regexp"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/grobie/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 )
 
 func TestAcceptance(t *testing.T) {
@@ -145,3 +148,88 @@ OUTER:
 
 	<-errc
 }
+
+func TestCollectDrift(t *testing.T) {
+	e := NewExporter("localhost:11211", time.Second, ExporterOpts{
+		ExpectedSettings: map[string]string{
+			"maxconns":       "1024",
+			"growth_factor":  "1.25",
+			"num_threads":    "8",
+			"limit_maxbytes": "67108864",
+		},
+	})
+	settings := map[string]string{"maxconns": "1024", "growth_factor": "1.250", "num_threads": "4"}
+	stats := map[string]string{"limit_maxbytes": "33554432"}
+
+	ch := make(chan prometheus.Metric, 10)
+	e.collectDrift(ch, settings, stats)
+	close(ch)
+
+	drifted := map[string]string{}
+	var count float64
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		if m.Desc() == e.settingDriftCount {
+			count = pb.GetGauge().GetValue()
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		drifted[labels["name"]] = labels["actual"]
+	}
+
+	want := map[string]string{"num_threads": "4", "limit_maxbytes": "33554432"}
+	if len(drifted) != len(want) {
+		t.Fatalf("want drift for %v, have %v", want, drifted)
+	}
+	for name, actual := range want {
+		if drifted[name] != actual {
+			t.Errorf("want %s drifted to %q, have %q", name, actual, drifted[name])
+		}
+	}
+	if count != 2 {
+		t.Errorf("want drift count 2, have %v", count)
+	}
+}
+
+func TestCollectPassthrough(t *testing.T) {
+	e := NewExporter("localhost:11211", time.Second, ExporterOpts{
+		Passthrough:     true,
+		PassthroughDeny: regexp.MustCompile("^rusage_.*$"),
+	})
+	stats := map[string]string{
+		"curr_items":               "3",
+		"rusage_user":              "0.123",
+		"libevent":                 "2.1.8-stable",
+		"get_expired":              "4",
+		"slab_reassign_busy_items": "1",
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	e.collectPassthrough(ch, stats)
+	close(ch)
+
+	have := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		have[pb.GetLabel()[0].GetValue()] = pb.GetUntyped().GetValue()
+	}
+
+	want := map[string]float64{"get_expired": 4, "slab_reassign_busy_items": 1}
+	if len(have) != len(want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	for name, v := range want {
+		if have[name] != v {
+			t.Errorf("want %s %v, have %v", name, v, have[name])
+		}
+	}
+}
@@ -0,0 +1,300 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// statSource is the memcached command a stat is read from.
+type statSource int
+
+const (
+	// sourceStats are the general stats of `stats` (and the global lines of
+	// `stats slabs`).
+	sourceStats statSource = iota
+	// sourceSettings are the stats of `stats settings`.
+	sourceSettings
+	// sourceItems are the per slab class stats of `stats items`.
+	sourceItems
+	// sourceSlabs are the per slab class stats of `stats slabs`.
+	sourceSlabs
+)
+
+// semver is a memcached server version.
+type semver struct {
+	major, minor, patch int
+}
+
+// parseSemver parses a memcached version like "1.6.9". Suffixes of the patch
+// version, e.g. "1.4.4-14-g9c660c0", are ignored.
+func parseSemver(s string) (semver, error) {
+	parts := strings.SplitN(s, ".", 3)
+	if len(parts) != 3 {
+		return semver{}, fmt.Errorf("invalid version %q", s)
+	}
+	if i := strings.IndexFunc(parts[2], func(r rune) bool { return r < '0' || r > '9' }); i >= 0 {
+		parts[2] = parts[2][:i]
+	}
+	var v [3]int
+	for i, p := range parts {
+		n, err := strconv.Atoi(p)
+		if err != nil {
+			return semver{}, fmt.Errorf("invalid version %q: %s", s, err)
+		}
+		v[i] = n
+	}
+	return semver{v[0], v[1], v[2]}, nil
+}
+
+// less reports whether v is an older version than o.
+func (v semver) less(o semver) bool {
+	if v.major != o.major {
+		return v.major < o.major
+	}
+	if v.minor != o.minor {
+		return v.minor < o.minor
+	}
+	return v.patch < o.patch
+}
+
+// statMapping maps a single memcached stat to a Prometheus metric.
+type statMapping struct {
+	source statSource
+	key    string
+	desc   *prometheus.Desc
+	// valueType is the type of the exported metric.
+	valueType prometheus.ValueType
+	// labelValues are appended to the slab label of per slab class stats.
+	labelValues []string
+	// minVersion is the first memcached version which reports the stat.
+	minVersion semver
+	// value extracts the value of key from the stats. It defaults to parse.
+	value func(stats map[string]string, key string) float64
+}
+
+func newDesc(subsystem, name, help string, labels ...string) *prometheus.Desc {
+	return prometheus.NewDesc(prometheus.BuildFQName(namespace, subsystem, name), help, labels, nil)
+}
+
+var (
+	uptimeDesc                = newDesc("", "uptime_seconds", "Number of seconds since the server started.")
+	bytesReadDesc             = newDesc("", "read_bytes_total", "Total number of bytes read by this server from network.")
+	bytesWrittenDesc          = newDesc("", "written_bytes_total", "Total number of bytes sent by this server to network.")
+	currentConnectionsDesc    = newDesc("", "current_connections", "Current number of open connections.")
+	maxConnectionsDesc        = newDesc("", "max_connections", "Maximum number of clients allowed.")
+	connectionsTotalDesc      = newDesc("", "connections_total", "Total number of connections opened since the server started running.")
+	connsYieldedTotalDesc     = newDesc("", "connections_yielded_total", "Total number of connections yielded running due to hitting the memcached's -R limit.")
+	listenerDisabledTotalDesc = newDesc("", "connections_listener_disabled_total", "Number of times that memcached has hit its connections limit and disabled its listener.")
+	currentBytesDesc          = newDesc("", "current_bytes", "Current number of bytes used to store items.")
+	limitBytesDesc            = newDesc("", "limit_bytes", "Number of bytes this server is allowed to use for storage.")
+	commandsDesc              = newDesc("", "commands_total", "Total number of all requests broken down by command (get, set, etc.) and status.", "command", "status")
+	itemsDesc                 = newDesc("", "current_items", "Current number of items stored by this instance.")
+	itemsTotalDesc            = newDesc("", "items_total", "Total number of items stored during the life of this instance.")
+	evictionsDesc             = newDesc("", "items_evicted_total", "Total number of valid items removed from cache to free memory for new items.")
+	reclaimedDesc             = newDesc("", "items_reclaimed_total", "Total number of times an entry was stored using memory from an expired entry.")
+	mallocedDesc              = newDesc("", "malloced_bytes", "Number of bytes of memory allocated to slab pages.")
+
+	lruCrawlerEnabledDesc        = newDesc(subsystemLruCrawler, "enabled", "Whether the LRU crawler is enabled.")
+	lruCrawlerSleepDesc          = newDesc(subsystemLruCrawler, "sleep", "Microseconds to sleep between LRU crawls.")
+	lruCrawlerMaxItemsDesc       = newDesc(subsystemLruCrawler, "to_crawl", "Max items to crawl per slab per run.")
+	lruMaintainerThreadDesc      = newDesc(subsystemLruCrawler, "maintainer_thread", "Split LRU mode and background threads.")
+	lruHotPercentDesc            = newDesc(subsystemLruCrawler, "hot_percent", "Percent of slab memory reserved for HOT LRU.")
+	lruWarmPercentDesc           = newDesc(subsystemLruCrawler, "warm_percent", "Percent of slab memory reserved for WARM LRU.")
+	lruHotMaxAgeFactorDesc       = newDesc(subsystemLruCrawler, "hot_max_factor", "Set idle age of HOT LRU to COLD age * this")
+	lruWarmMaxAgeFactorDesc      = newDesc(subsystemLruCrawler, "warm_max_factor", "Set idle age of WARM LRU to COLD age * this")
+	lruCrawlerStartsDesc         = newDesc(subsystemLruCrawler, "starts", "Times an LRU crawler was started.")
+	lruCrawlerReclaimedDesc      = newDesc(subsystemLruCrawler, "reclaimed_total", "Total items freed by LRU Crawler.")
+	lruCrawlerItemsCheckedDesc   = newDesc(subsystemLruCrawler, "items_checked_total", "Total items examined by LRU Crawler.")
+	lruCrawlerMovesToColdDesc    = newDesc(subsystemLruCrawler, "moves_to_cold_total", "Total number of items moved from HOT/WARM to COLD LRU's.")
+	lruCrawlerMovesToWarmDesc    = newDesc(subsystemLruCrawler, "moves_to_warm_total", "Total number of items moved from COLD to WARM LRU.")
+	lruCrawlerMovesWithinLruDesc = newDesc(subsystemLruCrawler, "moves_within_lru_total", "Total number of items reshuffled within HOT or WARM LRU's.")
+
+	itemsNumberDesc           = newDesc(subsystemSlab, "current_items", "Number of items currently stored in this slab class.", "slab")
+	itemsAgeDesc              = newDesc(subsystemSlab, "items_age_seconds", "Number of seconds the oldest item has been in the slab class.", "slab")
+	itemsCrawlerReclaimedDesc = newDesc(subsystemSlab, "items_crawler_reclaimed_total", "Number of items freed by the LRU Crawler.", "slab")
+	itemsEvictedDesc          = newDesc(subsystemSlab, "items_evicted_total", "Total number of times an item had to be evicted from the LRU before it expired.", "slab")
+	itemsEvictedNonzeroDesc   = newDesc(subsystemSlab, "items_evicted_nonzero_total", "Total number of times an item which had an explicit expire time set had to be evicted from the LRU before it expired.", "slab")
+	itemsEvictedTimeDesc      = newDesc(subsystemSlab, "items_evicted_time_seconds", "Seconds since the last access for the most recent item evicted from this class.", "slab")
+	itemsEvictedUnfetchedDesc = newDesc(subsystemSlab, "items_evicted_unfetched_total", "Total nmber of items evicted and never fetched.", "slab")
+	itemsExpiredUnfetchedDesc = newDesc(subsystemSlab, "items_expired_unfetched_total", "Total number of valid items evicted from the LRU which were never touched after being set.", "slab")
+	itemsOutofmemoryDesc      = newDesc(subsystemSlab, "items_outofmemory_total", "Total number of items for this slab class that have triggered an out of memory error.", "slab")
+	itemsReclaimedDesc        = newDesc(subsystemSlab, "items_reclaimed_total", "Total number of items reclaimed.", "slab")
+	itemsTailrepairsDesc      = newDesc(subsystemSlab, "items_tailrepairs_total", "Total number of times the entries for a particular ID need repairing.", "slab")
+	itemsMovesToColdDesc      = newDesc(subsystemSlab, "items_moves_to_cold", "Number of items moved from HOT or WARM into COLD.", "slab")
+	itemsMovesToWarmDesc      = newDesc(subsystemSlab, "items_moves_to_warm", "Number of items moves from COLD into WARM.", "slab")
+	itemsMovesWithinLruDesc   = newDesc(subsystemSlab, "items_moves_within_lru", "Number of times active items were bumped within HOT or WARM.", "slab")
+
+	slabsChunkSizeDesc     = newDesc(subsystemSlab, "chunk_size_bytes", "Number of bytes allocated to each chunk within this slab class.", "slab")
+	slabsChunksPerPageDesc = newDesc(subsystemSlab, "chunks_per_page", "Number of chunks within a single page for this slab class.", "slab")
+	slabsCurrentPagesDesc  = newDesc(subsystemSlab, "current_pages", "Number of pages allocated to this slab class.", "slab")
+	slabsCurrentChunksDesc = newDesc(subsystemSlab, "current_chunks", "Number of chunks allocated to this slab class.", "slab")
+	slabsChunksUsedDesc    = newDesc(subsystemSlab, "chunks_used", "Number of chunks allocated to an item.", "slab")
+	slabsChunksFreeDesc    = newDesc(subsystemSlab, "chunks_free", "Number of chunks not yet allocated items.", "slab")
+	slabsChunksFreeEndDesc = newDesc(subsystemSlab, "chunks_free_end", "Number of free chunks at the end of the last allocated page.", "slab")
+	slabsMemRequestedDesc  = newDesc(subsystemSlab, "mem_requested_bytes", "Number of bytes of memory actual items take up within a slab.", "slab")
+	slabsCommandsDesc      = newDesc(subsystemSlab, "commands_total", "Total number of all requests broken down by command (get, set, etc.) and status per slab.", "slab", "command", "status")
+)
+
+var (
+	v1_4_0  = semver{1, 4, 0}
+	v1_4_8  = semver{1, 4, 8}
+	v1_4_18 = semver{1, 4, 18}
+	v1_4_22 = semver{1, 4, 22}
+	v1_4_24 = semver{1, 4, 24}
+	v1_5_0  = semver{1, 5, 0}
+)
+
+// statMappings lists every stat exported by the exporter. Describe and Collect
+// are both driven by it.
+var statMappings = []statMapping{
+	{source: sourceStats, key: "uptime", desc: uptimeDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+
+	{source: sourceStats, key: "get_hits", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"get", "hit"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "get_misses", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"get", "miss"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "delete_hits", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"delete", "hit"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "delete_misses", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"delete", "miss"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "incr_hits", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"incr", "hit"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "incr_misses", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"incr", "miss"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "decr_hits", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"decr", "hit"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "decr_misses", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"decr", "miss"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "cas_hits", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"cas", "hit"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "cas_misses", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"cas", "miss"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "cas_badval", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"cas", "badval"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "touch_hits", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"touch", "hit"}, minVersion: v1_4_8},
+	{source: sourceStats, key: "touch_misses", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"touch", "miss"}, minVersion: v1_4_8},
+	{source: sourceStats, key: "cmd_flush", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"flush", "hit"}, minVersion: v1_4_0},
+	{source: sourceStats, key: "cmd_set", desc: commandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"set", "hit"}, minVersion: v1_4_0, value: setValue("cas_misses", "cas_hits", "cas_badval")},
+
+	{source: sourceStats, key: "bytes", desc: currentBytesDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "limit_maxbytes", desc: limitBytesDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "curr_items", desc: itemsDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "total_items", desc: itemsTotalDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "bytes_read", desc: bytesReadDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "bytes_written", desc: bytesWrittenDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "curr_connections", desc: currentConnectionsDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "total_connections", desc: connectionsTotalDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "conn_yields", desc: connsYieldedTotalDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "listen_disabled_num", desc: listenerDisabledTotalDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "evictions", desc: evictionsDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "reclaimed", desc: reclaimedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceStats, key: "lru_crawler_starts", desc: lruCrawlerStartsDesc, valueType: prometheus.UntypedValue, minVersion: v1_4_22},
+	{source: sourceStats, key: "crawler_items_checked", desc: lruCrawlerItemsCheckedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_24},
+	{source: sourceStats, key: "crawler_reclaimed", desc: lruCrawlerReclaimedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_18},
+	{source: sourceStats, key: "moves_to_cold", desc: lruCrawlerMovesToColdDesc, valueType: prometheus.CounterValue, minVersion: v1_4_24},
+	{source: sourceStats, key: "moves_to_warm", desc: lruCrawlerMovesToWarmDesc, valueType: prometheus.CounterValue, minVersion: v1_4_24},
+	{source: sourceStats, key: "moves_within_lru", desc: lruCrawlerMovesWithinLruDesc, valueType: prometheus.CounterValue, minVersion: v1_4_24},
+	{source: sourceStats, key: "total_malloced", desc: mallocedDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+
+	{source: sourceSettings, key: "maxconns", desc: maxConnectionsDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSettings, key: "lru_crawler", desc: lruCrawlerEnabledDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_18, value: parseBool},
+	{source: sourceSettings, key: "lru_crawler_sleep", desc: lruCrawlerSleepDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_18},
+	{source: sourceSettings, key: "lru_crawler_tocrawl", desc: lruCrawlerMaxItemsDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_18},
+	{source: sourceSettings, key: "lru_maintainer_thread", desc: lruMaintainerThreadDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_24, value: parseBool},
+	{source: sourceSettings, key: "hot_lru_pct", desc: lruHotPercentDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_24},
+	{source: sourceSettings, key: "warm_lru_pct", desc: lruWarmPercentDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_24},
+	{source: sourceSettings, key: "hot_max_factor", desc: lruHotMaxAgeFactorDesc, valueType: prometheus.GaugeValue, minVersion: v1_5_0},
+	{source: sourceSettings, key: "warm_max_factor", desc: lruWarmMaxAgeFactorDesc, valueType: prometheus.GaugeValue, minVersion: v1_5_0},
+
+	{source: sourceItems, key: "number", desc: itemsNumberDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "age", desc: itemsAgeDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "crawler_reclaimed", desc: itemsCrawlerReclaimedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_18},
+	{source: sourceItems, key: "evicted", desc: itemsEvictedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "evicted_nonzero", desc: itemsEvictedNonzeroDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "evicted_time", desc: itemsEvictedTimeDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "evicted_unfetched", desc: itemsEvictedUnfetchedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "expired_unfetched", desc: itemsExpiredUnfetchedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "outofmemory", desc: itemsOutofmemoryDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "reclaimed", desc: itemsReclaimedDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "tailrepairs", desc: itemsTailrepairsDesc, valueType: prometheus.CounterValue, minVersion: v1_4_0},
+	{source: sourceItems, key: "moves_to_cold", desc: itemsMovesToColdDesc, valueType: prometheus.CounterValue, minVersion: v1_4_24},
+	{source: sourceItems, key: "moves_to_warm", desc: itemsMovesToWarmDesc, valueType: prometheus.CounterValue, minVersion: v1_4_24},
+	{source: sourceItems, key: "moves_within_lru", desc: itemsMovesWithinLruDesc, valueType: prometheus.CounterValue, minVersion: v1_4_24},
+
+	{source: sourceSlabs, key: "get_hits", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"get", "hit"}, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "delete_hits", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"delete", "hit"}, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "incr_hits", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"incr", "hit"}, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "decr_hits", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"decr", "hit"}, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "cas_hits", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"cas", "hit"}, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "cas_badval", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"cas", "badval"}, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "touch_hits", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"touch", "hit"}, minVersion: v1_4_8},
+	{source: sourceSlabs, key: "cmd_set", desc: slabsCommandsDesc, valueType: prometheus.CounterValue, labelValues: []string{"set", "hit"}, minVersion: v1_4_0, value: setValue("cas_hits", "cas_badval")},
+	{source: sourceSlabs, key: "chunk_size", desc: slabsChunkSizeDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "chunks_per_page", desc: slabsChunksPerPageDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "total_pages", desc: slabsCurrentPagesDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "total_chunks", desc: slabsCurrentChunksDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "used_chunks", desc: slabsChunksUsedDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "free_chunks", desc: slabsChunksFreeDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "free_chunks_end", desc: slabsChunksFreeEndDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+	{source: sourceSlabs, key: "mem_requested", desc: slabsMemRequestedDesc, valueType: prometheus.GaugeValue, minVersion: v1_4_0},
+}
+
+// setValue returns a value function for cmd_set. memcached includes cas
+// operations again in cmd_set, so the given cas keys are subtracted.
+func setValue(casKeys ...string) func(map[string]string, string) float64 {
+	return func(stats map[string]string, key string) float64 {
+		set, err := strconv.ParseFloat(stats[key], 64)
+		if err != nil {
+			log.Errorf("Failed to parse set %q: %s", stats[key], err)
+			return math.NaN()
+		}
+		cas, err := sum(stats, casKeys...)
+		if err != nil {
+			log.Errorf("Failed to parse cas: %s", err)
+			return math.NaN()
+		}
+		return set - cas
+	}
+}
+
+// collectMappings exports all mappings of the given source which are
+// supported by the server version. A zero version disables the version check.
+// Per slab class sources are exported once per slab with the slab id as first
+// label value. Stats the server should report but doesn't are counted instead
+// of exported.
+func (e *Exporter) collectMappings(ch chan<- prometheus.Metric, source statSource, version semver, stats map[string]string, labelValues ...string) {
+	for _, m := range statMappings {
+		if m.source != source || (version != (semver{}) && version.less(m.minVersion)) {
+			continue
+		}
+		if _, ok := stats[m.key]; !ok {
+			e.missingStats.WithLabelValues(m.key).Inc()
+			continue
+		}
+		value := m.value
+		if value == nil {
+			value = parse
+		}
+		lvs := append(append([]string{}, labelValues...), m.labelValues...)
+		ch <- prometheus.MustNewConstMetric(m.desc, m.valueType, value(stats, m.key), lvs...)
+	}
+}
+
+// describeMappings sends the unique descriptors of all mappings.
+func describeMappings(ch chan<- *prometheus.Desc) {
+	seen := map[*prometheus.Desc]bool{}
+	for _, m := range statMappings {
+		if seen[m.desc] {
+			continue
+		}
+		seen[m.desc] = true
+		ch <- m.desc
+	}
+}
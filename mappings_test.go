@@ -0,0 +1,291 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// statsFixture is the output of the stats commands of a memcached version.
+type statsFixture struct {
+	version  semver
+	stats    map[string]string
+	settings map[string]string
+	items    map[int]map[string]string
+	slabs    map[int]map[string]string
+}
+
+var statsFixtures = map[string]statsFixture{
+	"1.4.15": {
+		version: semver{1, 4, 15},
+		stats: map[string]string{
+			"pid": "1", "uptime": "120", "time": "1560000000", "version": "1.4.15",
+			"curr_connections": "10", "total_connections": "12", "connection_structures": "11",
+			"cmd_get": "4", "cmd_set": "4", "cmd_flush": "0", "cmd_touch": "0",
+			"get_hits": "3", "get_misses": "1", "delete_misses": "0", "delete_hits": "0",
+			"incr_misses": "0", "incr_hits": "0", "decr_misses": "0", "decr_hits": "0",
+			"cas_misses": "0", "cas_hits": "1", "cas_badval": "0", "touch_hits": "0", "touch_misses": "0",
+			"auth_cmds": "0", "auth_errors": "0", "bytes_read": "200", "bytes_written": "300",
+			"limit_maxbytes": "67108864", "accepting_conns": "1", "listen_disabled_num": "0",
+			"threads": "4", "conn_yields": "0", "hash_power_level": "16", "hash_bytes": "524288",
+			"hash_is_expanding": "0", "bytes": "262", "curr_items": "2", "total_items": "4",
+			"expired_unfetched": "0", "evicted_unfetched": "0", "evictions": "0", "reclaimed": "0",
+			"active_slabs": "2", "total_malloced": "2097152",
+		},
+		settings: map[string]string{
+			"maxbytes": "67108864", "maxconns": "1024", "tcpport": "11211", "growth_factor": "1.25",
+			"chunk_size": "48", "num_threads": "4", "cas_enabled": "yes", "item_size_max": "1048576",
+		},
+		items: map[int]map[string]string{
+			1: {
+				"number": "1", "age": "10", "evicted": "0", "evicted_nonzero": "0", "evicted_time": "0",
+				"outofmemory": "0", "tailrepairs": "0", "reclaimed": "0", "expired_unfetched": "0",
+				"evicted_unfetched": "0",
+			},
+		},
+		slabs: map[int]map[string]string{
+			1: {
+				"chunk_size": "96", "chunks_per_page": "10922", "total_pages": "1", "total_chunks": "10922",
+				"used_chunks": "1", "free_chunks": "10921", "free_chunks_end": "0", "mem_requested": "68",
+				"get_hits": "3", "cmd_set": "3", "delete_hits": "0", "incr_hits": "0", "decr_hits": "0",
+				"cas_hits": "1", "cas_badval": "0", "touch_hits": "0",
+			},
+		},
+	},
+	"1.6.9": {
+		version: semver{1, 6, 9},
+		stats: map[string]string{
+			"pid": "1", "uptime": "120", "time": "1600000000", "version": "1.6.9", "libevent": "2.1.8-stable",
+			"pointer_size": "64", "rusage_user": "0.010000", "rusage_system": "0.020000",
+			"max_connections": "1024", "curr_connections": "2", "total_connections": "3",
+			"rejected_connections": "0", "connection_structures": "3", "response_obj_oom": "0",
+			"cmd_get": "4", "cmd_set": "4", "cmd_flush": "0", "cmd_touch": "0", "cmd_meta": "0",
+			"get_hits": "3", "get_misses": "1", "get_expired": "0", "get_flushed": "0",
+			"delete_misses": "0", "delete_hits": "0", "incr_misses": "0", "incr_hits": "0",
+			"decr_misses": "0", "decr_hits": "0", "cas_misses": "0", "cas_hits": "1", "cas_badval": "0",
+			"touch_hits": "0", "touch_misses": "0", "store_too_large": "0", "store_no_memory": "0",
+			"auth_cmds": "0", "auth_errors": "0", "bytes_read": "200", "bytes_written": "300",
+			"limit_maxbytes": "67108864", "accepting_conns": "1", "listen_disabled_num": "0",
+			"time_in_listen_disabled_us": "0", "threads": "4", "conn_yields": "0",
+			"hash_power_level": "16", "hash_bytes": "524288", "hash_is_expanding": "0",
+			"slab_reassign_rescues": "0", "slab_reassign_chunk_rescues": "0",
+			"slab_reassign_evictions_nomem": "0", "slab_reassign_inline_reclaim": "0",
+			"slab_reassign_busy_items": "0", "slab_reassign_busy_deletes": "0",
+			"slab_reassign_running": "0", "slabs_moved": "0", "lru_crawler_running": "0",
+			"lru_crawler_starts": "6", "lru_maintainer_juggles": "200", "malloc_fails": "0",
+			"log_worker_dropped": "0", "log_worker_written": "0", "log_watcher_skipped": "0",
+			"log_watcher_sent": "0", "unexpected_napi_ids": "0", "round_robin_fallback": "0",
+			"bytes": "262", "curr_items": "2", "total_items": "4", "slab_global_page_pool": "0",
+			"expired_unfetched": "0", "evicted_unfetched": "0", "evicted_active": "0",
+			"evictions": "0", "reclaimed": "0", "crawler_reclaimed": "0", "crawler_items_checked": "2",
+			"lrutail_reflocked": "0", "moves_to_cold": "2", "moves_to_warm": "0",
+			"moves_within_lru": "0", "direct_reclaims": "0", "lru_bumps_dropped": "0",
+			"active_slabs": "2", "total_malloced": "2097152",
+		},
+		settings: map[string]string{
+			"maxbytes": "67108864", "maxconns": "1024", "tcpport": "11211", "growth_factor": "1.25",
+			"chunk_size": "48", "num_threads": "4", "cas_enabled": "yes", "item_size_max": "1048576",
+			"lru_crawler": "yes", "lru_crawler_sleep": "100", "lru_crawler_tocrawl": "0",
+			"lru_maintainer_thread": "yes", "hot_lru_pct": "20", "warm_lru_pct": "40",
+			"hot_max_factor": "0.20", "warm_max_factor": "2.00", "temp_lru": "no",
+		},
+		items: map[int]map[string]string{
+			1: {
+				"number": "1", "number_hot": "0", "number_warm": "0", "number_cold": "1",
+				"age_hot": "0", "age_warm": "0", "age": "10", "mem_requested": "68",
+				"evicted": "0", "evicted_nonzero": "0", "evicted_time": "0", "outofmemory": "0",
+				"tailrepairs": "0", "reclaimed": "0", "expired_unfetched": "0", "evicted_unfetched": "0",
+				"evicted_active": "0", "crawler_reclaimed": "0", "crawler_items_checked": "2",
+				"lrutail_reflocked": "0", "moves_to_cold": "2", "moves_to_warm": "0",
+				"moves_within_lru": "0", "direct_reclaims": "0", "hits_to_hot": "0",
+				"hits_to_warm": "0", "hits_to_cold": "3", "hits_to_temp": "0",
+			},
+		},
+		slabs: map[int]map[string]string{
+			1: {
+				"chunk_size": "96", "chunks_per_page": "10922", "total_pages": "1", "total_chunks": "10922",
+				"used_chunks": "1", "free_chunks": "10921", "free_chunks_end": "0", "mem_requested": "68",
+				"get_hits": "3", "cmd_set": "3", "delete_hits": "0", "incr_hits": "0", "decr_hits": "0",
+				"cas_hits": "1", "cas_badval": "0", "touch_hits": "0",
+			},
+		},
+	},
+}
+
+// metricKey identifies an exported series by its descriptor and sorted label
+// values.
+func metricKey(t *testing.T, m prometheus.Metric) (string, float64) {
+	var pb dto.Metric
+	if err := m.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	var lvs []string
+	for _, l := range pb.GetLabel() {
+		lvs = append(lvs, l.GetValue())
+	}
+	sort.Strings(lvs)
+
+	var v float64
+	switch {
+	case pb.Counter != nil:
+		v = pb.GetCounter().GetValue()
+	case pb.Gauge != nil:
+		v = pb.GetGauge().GetValue()
+	default:
+		v = pb.GetUntyped().GetValue()
+	}
+	return m.Desc().String() + strings.Join(lvs, ","), v
+}
+
+func TestStatMappings(t *testing.T) {
+	e := NewExporter("localhost:11211", time.Second, ExporterOpts{})
+
+	for name, f := range statsFixtures {
+		ch := make(chan prometheus.Metric, 1000)
+		e.collectStats(ch, f.stats, f.items, f.slabs)
+		e.collectMappings(ch, sourceSettings, f.version, f.settings)
+		close(ch)
+
+		have := map[string]float64{}
+		for m := range ch {
+			k, v := metricKey(t, m)
+			have[k] = v
+		}
+
+		for _, m := range statMappings {
+			lvs := append([]string{}, m.labelValues...)
+			if m.source == sourceItems || m.source == sourceSlabs {
+				lvs = append(lvs, "1")
+			}
+			sort.Strings(lvs)
+
+			v, ok := have[m.desc.String()+strings.Join(lvs, ",")]
+			if f.version.less(m.minVersion) {
+				if ok {
+					t.Errorf("%s: want %s %v not to be exported", name, m.key, m.labelValues)
+				}
+				continue
+			}
+			if !ok {
+				t.Errorf("%s: want %s %v to be exported", name, m.key, m.labelValues)
+				continue
+			}
+			if math.IsNaN(v) {
+				t.Errorf("%s: want %s %v to have a value, have NaN", name, m.key, m.labelValues)
+			}
+		}
+	}
+
+	missing := make(chan prometheus.Metric, 100)
+	e.missingStats.Collect(missing)
+	close(missing)
+	for m := range missing {
+		k, _ := metricKey(t, m)
+		t.Errorf("want no missing stats, have %s", k)
+	}
+}
+
+func TestUnparseableVersion(t *testing.T) {
+	e := NewExporter("localhost:11211", time.Second, ExporterOpts{})
+	stats := map[string]string{}
+	for k, v := range statsFixtures["1.6.9"].stats {
+		stats[k] = v
+	}
+	stats["version"] = "weird"
+
+	ch := make(chan prometheus.Metric, 1000)
+	e.collectStats(ch, stats, nil, nil)
+	close(ch)
+
+	have := map[string]float64{}
+	for m := range ch {
+		k, v := metricKey(t, m)
+		have[k] = v
+	}
+	if v, ok := have[uptimeDesc.String()]; !ok || v != 120 {
+		t.Errorf("want uptime 120 for an unparseable version, have %v", have)
+	}
+}
+
+func TestMissingStats(t *testing.T) {
+	e := NewExporter("localhost:11211", time.Second, ExporterOpts{})
+	f := statsFixtures["1.6.9"]
+	stats := map[string]string{}
+	for k, v := range f.stats {
+		stats[k] = v
+	}
+	delete(stats, "moves_to_cold")
+
+	ch := make(chan prometheus.Metric, 1000)
+	e.collectStats(ch, stats, nil, nil)
+	close(ch)
+
+	missing := make(chan prometheus.Metric, 100)
+	e.missingStats.Collect(missing)
+	close(missing)
+
+	have := map[string]float64{}
+	for m := range missing {
+		var pb dto.Metric
+		if err := m.Write(&pb); err != nil {
+			t.Fatal(err)
+		}
+		have[pb.GetLabel()[0].GetValue()] = pb.GetCounter().GetValue()
+	}
+	if len(have) != 1 || have["moves_to_cold"] != 1 {
+		t.Errorf("want moves_to_cold to be missing once, have %v", have)
+	}
+}
+
+func TestParseSemver(t *testing.T) {
+	for in, want := range map[string]semver{
+		"1.6.9":             {1, 6, 9},
+		"1.4.4-14-g9c660c0": {1, 4, 4},
+		"1.5.0_rc1":         {1, 5, 0},
+	} {
+		have, err := parseSemver(in)
+		if err != nil {
+			t.Errorf("%s: %s", in, err)
+		}
+		if have != want {
+			t.Errorf("%s: want %v, have %v", in, want, have)
+		}
+	}
+	if _, err := parseSemver("unknown"); err == nil {
+		t.Error("want error for invalid version")
+	}
+}
+
+func TestDescribeUnique(t *testing.T) {
+	e := NewExporter("localhost:11211", time.Second, ExporterOpts{})
+
+	ch := make(chan *prometheus.Desc, 1000)
+	e.Describe(ch)
+	close(ch)
+
+	seen := map[string]bool{}
+	for d := range ch {
+		if seen[d.String()] {
+			t.Errorf("%s described more than once", d)
+		}
+		seen[d.String()] = true
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// metaConn speaks the meta protocol of memcached 1.6, which is also the only
+// protocol some proxies accept.
+type metaConn struct {
+	conn    net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// meta opens a connection for meta commands.
+func (d *Dialer) meta(address string, timeout time.Duration) (*metaConn, error) {
+	conn, err := d.dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &metaConn{conn: conn, r: bufio.NewReader(conn), timeout: timeout}, nil
+}
+
+func (c *metaConn) Close() error {
+	return c.conn.Close()
+}
+
+// metaItem is the result of a meta get. Flags holds the returned flags by
+// letter, e.g. 't' for the remaining TTL.
+type metaItem struct {
+	Value []byte
+	Flags map[byte]string
+}
+
+// int returns the integer value of a returned flag, or false if it is
+// missing.
+func (it *metaItem) int(flag byte) (int64, bool) {
+	v, err := strconv.ParseInt(it.Flags[flag], 10, 64)
+	return v, err == nil
+}
+
+// command sends a command with an optional data block and returns the
+// response line.
+func (c *metaConn) command(cmd string, data []byte) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	msg := cmd + "\r\n"
+	if data != nil {
+		msg += string(data) + "\r\n"
+	}
+	if _, err := io.WriteString(c.conn, msg); err != nil {
+		return "", err
+	}
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if err := protocolError(line); err != nil {
+		return "", err
+	}
+	return line, nil
+}
+
+// noop sends `mn`, which is answered with "MN".
+func (c *metaConn) noop() error {
+	line, err := c.command("mn", nil)
+	if err != nil {
+		return err
+	}
+	if line != "MN" {
+		return fmt.Errorf("unexpected no-op response %q", line)
+	}
+	return nil
+}
+
+// get sends `mg <key> <flags>`. It returns nil if the key is missing. The
+// value is only returned with the v flag.
+func (c *metaConn) get(key string, flags ...string) (*metaItem, error) {
+	line, err := c.command(strings.Join(append([]string{"mg", key}, flags...), " "), nil)
+	if err != nil {
+		return nil, err
+	}
+	f := strings.Fields(line)
+	if len(f) == 0 {
+		return nil, fmt.Errorf("empty meta get response")
+	}
+	it := &metaItem{Flags: map[byte]string{}}
+	switch f[0] {
+	case "EN":
+		return nil, nil
+	case "HD":
+		f = f[1:]
+	case "VA":
+		if len(f) < 2 {
+			return nil, fmt.Errorf("unexpected meta get response %q", line)
+		}
+		size, err := strconv.Atoi(f[1])
+		if err != nil {
+			return nil, fmt.Errorf("unexpected meta get response %q", line)
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return nil, err
+		}
+		it.Value = data[:size]
+		f = f[2:]
+	default:
+		return nil, fmt.Errorf("unexpected meta get response %q", line)
+	}
+	for _, flag := range f {
+		it.Flags[flag[0]] = flag[1:]
+	}
+	return it, nil
+}
+
+// set sends `ms <key> <size> T<ttl>` with the value.
+func (c *metaConn) set(key string, value []byte, ttl time.Duration) error {
+	line, err := c.command(fmt.Sprintf("ms %s %d T%d", key, len(value), int64(ttl.Seconds())), value)
+	if err != nil {
+		return err
+	}
+	if line != "HD" {
+		return fmt.Errorf("unexpected meta set response %q", line)
+	}
+	return nil
+}
+
+// delete sends `md <key>`. Missing keys aren't an error.
+func (c *metaConn) delete(key string) error {
+	line, err := c.command("md "+key, nil)
+	if err != nil {
+		return err
+	}
+	if line != "HD" && line != "NF" {
+		return fmt.Errorf("unexpected meta delete response %q", line)
+	}
+	return nil
+}
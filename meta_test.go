@@ -0,0 +1,56 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMetaConn(t *testing.T) {
+	_, addr := newStorageServer(t)
+	c, err := (*Dialer)(nil).meta(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	if err := c.noop(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.set("flags", []byte("blob"), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	it, err := c.get("flags", "s", "t")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size, _ := it.int('s'); it.Value != nil || size != 4 || it.Flags['t'] != "0" {
+		t.Errorf("unexpected item %+v", it)
+	}
+	if it, err = c.get("flags", "v"); err != nil || string(it.Value) != "blob" {
+		t.Errorf("unexpected item %+v: %v", it, err)
+	}
+
+	if err := c.delete("flags"); err != nil {
+		t.Fatal(err)
+	}
+	if it, err := c.get("flags", "v"); err != nil || it != nil {
+		t.Errorf("want missing key, have %+v: %v", it, err)
+	}
+	if err := c.delete("flags"); err != nil {
+		t.Errorf("want no error for missing key, have %v", err)
+	}
+}
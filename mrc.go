@@ -0,0 +1,248 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var estimatedHitRatioDesc = newDesc("", "estimated_hit_ratio", "Estimated get hit ratio of an LRU cache of this size for the observed workload.", "cache_size_bytes")
+
+// parseByteSizes parses a comma separated list of sizes like "512MB,1GB". The
+// units KB, MB and GB are powers of 1024.
+func parseByteSizes(s string) ([]float64, error) {
+	units := map[string]float64{"KB": 1 << 10, "MB": 1 << 20, "GB": 1 << 30, "B": 1}
+	var sizes []float64
+	for _, f := range strings.Split(s, ",") {
+		f = strings.ToUpper(strings.TrimSpace(f))
+		mult := 1.
+		for _, u := range []string{"KB", "MB", "GB", "B"} {
+			if strings.HasSuffix(f, u) {
+				f, mult = strings.TrimSuffix(f, u), units[u]
+				break
+			}
+		}
+		v, err := strconv.ParseFloat(f, 64)
+		if err != nil || v <= 0 {
+			return nil, fmt.Errorf("invalid size %q", f)
+		}
+		sizes = append(sizes, v*mult)
+	}
+	sort.Float64s(sizes)
+	return sizes, nil
+}
+
+// fenwickTree is a binary indexed tree of byte sizes by access position.
+type fenwickTree []float64
+
+func (t fenwickTree) add(i int, v float64) {
+	for ; i < len(t); i += i & -i {
+		t[i] += v
+	}
+}
+
+// sum returns the sum of the positions 1 to i.
+func (t fenwickTree) sum(i int) float64 {
+	s := 0.
+	for ; i > 0; i -= i & -i {
+		s += t[i]
+	}
+	return s
+}
+
+// stackEntry is a sampled key in the LRU stack.
+type stackEntry struct {
+	key  string
+	pos  int
+	size float64
+}
+
+// MRCOpts configures the miss ratio curve aggregator.
+type MRCOpts struct {
+	// SampleRate is the fraction of keys which are simulated.
+	SampleRate float64
+	// MaxKeys caps the number of simulated keys. The least recently used
+	// keys are forgotten first.
+	MaxKeys int
+	// Sizes are the cache sizes in bytes to estimate the hit ratio for.
+	Sizes []float64
+}
+
+// mrcAggregator estimates the hit ratio of LRU caches of different sizes with
+// SHARDS: a spatially hashed sample of the keys is run through an LRU stack.
+// The byte stack distance of a get, scaled by the sample rate, is the
+// smallest cache size which would have served it.
+type mrcAggregator struct {
+	opts      MRCOpts
+	threshold uint64
+
+	mu    sync.Mutex
+	keys  map[string]*list.Element
+	lru   *list.List
+	tree  fenwickTree
+	clock int
+	bytes float64
+	// hits counts the sampled gets which would have been hits per size.
+	hits []float64
+	gets float64
+}
+
+func newMRCAggregator(opts MRCOpts) *mrcAggregator {
+	if opts.MaxKeys <= 0 {
+		opts.MaxKeys = 100000
+	}
+	return &mrcAggregator{
+		opts:      opts,
+		threshold: uint64(opts.SampleRate * float64(1<<32)),
+		keys:      map[string]*list.Element{},
+		lru:       list.New(),
+		tree:      make(fenwickTree, 2*opts.MaxKeys+1),
+		hits:      make([]float64, len(opts.Sizes)),
+	}
+}
+
+// sampled reports whether the key belongs to the spatial sample.
+func (a *mrcAggregator) sampled(key string) bool {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()%(1<<32) < a.threshold
+}
+
+func (a *mrcAggregator) streams() []string {
+	return []string{"fetchers", "mutations"}
+}
+
+func (a *mrcAggregator) observe(ev watchEvent) {
+	if ev.kind != "item_get" && ev.kind != "item_store" {
+		return
+	}
+	key := ev.key()
+	if !a.sampled(key) {
+		return
+	}
+	size, _ := ev.int("size")
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	el, ok := a.keys[key]
+	if ev.kind == "item_get" {
+		a.gets++
+		if ok {
+			e := el.Value.(*stackEntry)
+			// Bytes of all keys accessed since, including the key itself.
+			distance := (a.bytes - a.tree.sum(e.pos-1)) / a.opts.SampleRate
+			for i, s := range a.opts.Sizes {
+				if distance <= s {
+					a.hits[i]++
+				}
+			}
+		}
+		if ev.fields["status"] != "found" {
+			// Only stores make a key present.
+			if ok {
+				a.touch(el, el.Value.(*stackEntry).size)
+			}
+			return
+		}
+	}
+	if ok {
+		a.touch(el, float64(size))
+		return
+	}
+	a.insert(key, float64(size))
+}
+
+// touch moves a key to the top of the stack.
+func (a *mrcAggregator) touch(el *list.Element, size float64) {
+	e := el.Value.(*stackEntry)
+	a.tree.add(e.pos, -e.size)
+	a.bytes -= e.size
+	e.pos = 0
+	a.lru.MoveToFront(el)
+	a.push(e, size)
+}
+
+func (a *mrcAggregator) insert(key string, size float64) {
+	e := &stackEntry{key: key}
+	a.keys[key] = a.lru.PushFront(e)
+	a.push(e, size)
+
+	if a.lru.Len() > a.opts.MaxKeys {
+		el := a.lru.Back()
+		old := el.Value.(*stackEntry)
+		a.tree.add(old.pos, -old.size)
+		a.bytes -= old.size
+		a.lru.Remove(el)
+		delete(a.keys, old.key)
+	}
+}
+
+// push assigns the next position to an entry which is at the front of the
+// stack. Positions are renumbered once the tree is exhausted.
+func (a *mrcAggregator) push(e *stackEntry, size float64) {
+	if a.clock+1 >= len(a.tree) {
+		a.compact()
+	}
+	a.clock++
+	e.pos, e.size = a.clock, size
+	a.tree.add(e.pos, size)
+	a.bytes += size
+}
+
+// compact renumbers the positions of all entries in stack order.
+func (a *mrcAggregator) compact() {
+	for i := range a.tree {
+		a.tree[i] = 0
+	}
+	a.clock = 0
+	a.bytes = 0
+	for el := a.lru.Back(); el != nil; el = el.Prev() {
+		e := el.Value.(*stackEntry)
+		if e.pos == 0 {
+			// The entry being pushed.
+			continue
+		}
+		a.clock++
+		e.pos = a.clock
+		a.tree.add(e.pos, e.size)
+		a.bytes += e.size
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (a *mrcAggregator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- estimatedHitRatioDesc
+}
+
+// Collect implements prometheus.Collector.
+func (a *mrcAggregator) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if a.gets == 0 {
+		return
+	}
+	for i, s := range a.opts.Sizes {
+		ch <- prometheus.MustNewConstMetric(estimatedHitRatioDesc, prometheus.GaugeValue, a.hits[i]/a.gets, strconv.FormatFloat(s, 'f', -1, 64))
+	}
+}
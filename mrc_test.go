@@ -0,0 +1,72 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestParseByteSizes(t *testing.T) {
+	sizes, err := parseByteSizes("1GB, 512mb,100")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []float64{100, 512 << 20, 1 << 30}; !reflect.DeepEqual(sizes, want) {
+		t.Errorf("want %v, have %v", want, sizes)
+	}
+	if _, err := parseByteSizes("1TB"); err == nil {
+		t.Error("want error for unknown unit")
+	}
+}
+
+func TestMRCAggregator(t *testing.T) {
+	// The tree of 4 keys is compacted several times below.
+	a := newMRCAggregator(MRCOpts{SampleRate: 1, MaxKeys: 4, Sizes: []float64{200, 300}})
+
+	event := func(kind, key, status string) watchEvent {
+		return watchEvent{kind: kind, fields: map[string]string{"key": key, "status": status, "size": "100"}}
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		a.observe(event("item_store", k, "stored"))
+	}
+	// Cycling through three keys of 100 bytes hits in a 300 byte cache only.
+	for i := 0; i < 10; i++ {
+		for _, k := range []string{"a", "b", "c"} {
+			a.observe(event("item_get", k, "found"))
+		}
+	}
+	a.observe(event("item_get", "d", "not_found"))
+	a.observe(event("item_get", "c", "found"))
+
+	ch := make(chan prometheus.Metric, 10)
+	a.Collect(ch)
+	close(ch)
+	have := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		have[pb.GetLabel()[0].GetValue()] = pb.GetGauge().GetValue()
+	}
+	want := map[string]float64{"200": 1. / 32, "300": 31. / 32}
+	if !reflect.DeepEqual(have, want) {
+		t.Errorf("want %v, have %v", want, have)
+	}
+	if len(a.keys) != 3 {
+		t.Errorf("want 3 simulated keys, have %d", len(a.keys))
+	}
+}
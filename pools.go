@@ -0,0 +1,144 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+var (
+	poolNodesDesc        = newDesc("pool", "nodes", "Number of configured and discovered servers in the pool.", "pool")
+	poolNodesUpDesc      = newDesc("pool", "nodes_up", "Number of servers in the pool whose stats could be collected.", "pool")
+	poolLimitBytesDesc   = newDesc("pool", "limit_bytes", "Total storage limit of the reachable servers in the pool.", "pool")
+	poolCurrentBytesDesc = newDesc("pool", "current_bytes", "Total size of the items stored on the reachable servers in the pool.", "pool")
+	poolCurrentItemsDesc = newDesc("pool", "current_items", "Total number of items stored on the reachable servers in the pool.", "pool")
+	poolHitRatioDesc     = newDesc("pool", "hit_ratio", "Ratio of get hits to gets of the reachable servers in the pool since their start.", "pool")
+	poolNodeLoadMaxDesc  = newDesc("pool", "node_load_max", "Highest load metric of a reachable server in the pool.", "pool", "metric")
+	poolNodeLoadMinDesc  = newDesc("pool", "node_load_min", "Lowest load metric of a reachable server in the pool.", "pool", "metric")
+	poolNodeLoadStdDesc  = newDesc("pool", "node_load_stddev", "Standard deviation of the load metric across the reachable servers in the pool.", "pool", "metric")
+)
+
+// poolLoadStats are the stats compared across the servers of a pool, by the
+// value of the metric label.
+var poolLoadStats = map[string]string{
+	"items":       "curr_items",
+	"bytes":       "bytes",
+	"connections": "curr_connections",
+}
+
+// poolAggregator collects the stats of all servers of pools on every scrape
+// and exports aggregates, so that the pool totals don't depend on every
+// server being scraped successfully.
+type poolAggregator struct {
+	pools   []*Pool
+	timeout time.Duration
+}
+
+func newPoolAggregator(pools []*Pool, timeout time.Duration) *poolAggregator {
+	return &poolAggregator{pools: pools, timeout: timeout}
+}
+
+// Describe implements prometheus.Collector.
+func (a *poolAggregator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolNodesDesc
+	ch <- poolNodesUpDesc
+	ch <- poolLimitBytesDesc
+	ch <- poolCurrentBytesDesc
+	ch <- poolCurrentItemsDesc
+	ch <- poolHitRatioDesc
+	ch <- poolNodeLoadMaxDesc
+	ch <- poolNodeLoadMinDesc
+	ch <- poolNodeLoadStdDesc
+}
+
+// Collect implements prometheus.Collector.
+func (a *poolAggregator) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range a.pools {
+		servers := p.servers()
+		a.collectPool(ch, p.Name, len(servers), a.stats(p, servers))
+	}
+}
+
+// stats collects the stats of the servers of a pool concurrently. Servers
+// which can't be reached are missing.
+func (a *poolAggregator) stats(p *Pool, servers []string) []map[string]float64 {
+	var (
+		wg     sync.WaitGroup
+		mu     sync.Mutex
+		result []map[string]float64
+	)
+	for _, server := range servers {
+		wg.Add(1)
+		go func(server string) {
+			defer wg.Done()
+			stats, err := p.dialer.stats(server, a.timeout, "")
+			if err != nil {
+				log.Errorf("Failed to collect stats of %s in pool %s: %s", server, p.Name, err)
+				return
+			}
+			values := map[string]float64{}
+			for k, v := range stats {
+				if f, err := strconv.ParseFloat(v, 64); err == nil {
+					values[k] = f
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			result = append(result, values)
+		}(server)
+	}
+	wg.Wait()
+	return result
+}
+
+func (a *poolAggregator) collectPool(ch chan<- prometheus.Metric, pool string, servers int, nodes []map[string]float64) {
+	ch <- prometheus.MustNewConstMetric(poolNodesDesc, prometheus.GaugeValue, float64(servers), pool)
+	ch <- prometheus.MustNewConstMetric(poolNodesUpDesc, prometheus.GaugeValue, float64(len(nodes)), pool)
+	if len(nodes) == 0 {
+		return
+	}
+
+	sum := func(stat string) float64 {
+		s := 0.
+		for _, n := range nodes {
+			s += n[stat]
+		}
+		return s
+	}
+	ch <- prometheus.MustNewConstMetric(poolLimitBytesDesc, prometheus.GaugeValue, sum("limit_maxbytes"), pool)
+	ch <- prometheus.MustNewConstMetric(poolCurrentBytesDesc, prometheus.GaugeValue, sum("bytes"), pool)
+	ch <- prometheus.MustNewConstMetric(poolCurrentItemsDesc, prometheus.GaugeValue, sum("curr_items"), pool)
+	if gets := sum("cmd_get"); gets > 0 {
+		ch <- prometheus.MustNewConstMetric(poolHitRatioDesc, prometheus.GaugeValue, sum("get_hits")/gets, pool)
+	}
+
+	for metric, stat := range poolLoadStats {
+		min, max, mean := math.Inf(1), math.Inf(-1), sum(stat)/float64(len(nodes))
+		variance := 0.
+		for _, n := range nodes {
+			min = math.Min(min, n[stat])
+			max = math.Max(max, n[stat])
+			variance += (n[stat] - mean) * (n[stat] - mean) / float64(len(nodes))
+		}
+		ch <- prometheus.MustNewConstMetric(poolNodeLoadMaxDesc, prometheus.GaugeValue, max, pool, metric)
+		ch <- prometheus.MustNewConstMetric(poolNodeLoadMinDesc, prometheus.GaugeValue, min, pool, metric)
+		ch <- prometheus.MustNewConstMetric(poolNodeLoadStdDesc, prometheus.GaugeValue, math.Sqrt(variance), pool, metric)
+	}
+}
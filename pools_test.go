@@ -0,0 +1,61 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestPoolAggregator(t *testing.T) {
+	a := fakeServer(t, map[string]string{"stats": "STAT limit_maxbytes 1000\r\nSTAT bytes 100\r\nSTAT curr_items 10\r\nSTAT curr_connections 5\r\nSTAT cmd_get 10\r\nSTAT get_hits 10\r\nEND\r\n"})
+	b := fakeServer(t, map[string]string{"stats": "STAT limit_maxbytes 1000\r\nSTAT bytes 300\r\nSTAT curr_items 30\r\nSTAT curr_connections 5\r\nSTAT cmd_get 30\r\nSTAT get_hits 0\r\nEND\r\n"})
+	// A closed listener makes a server which is down.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	down := l.Addr().String()
+	l.Close()
+
+	pool := &Pool{Name: "cache", Servers: []string{a, b, down}, Aggregate: true}
+	ch := make(chan prometheus.Metric, 100)
+	newPoolAggregator([]*Pool{pool}, time.Second).Collect(ch)
+	close(ch)
+	have := map[string]float64{}
+	for m := range ch {
+		k, v := metricKey(t, m)
+		have[k] = v
+	}
+
+	for k, want := range map[string]float64{
+		poolNodesDesc.String() + "cache":                   3,
+		poolNodesUpDesc.String() + "cache":                 2,
+		poolLimitBytesDesc.String() + "cache":              2000,
+		poolCurrentBytesDesc.String() + "cache":            400,
+		poolCurrentItemsDesc.String() + "cache":            40,
+		poolHitRatioDesc.String() + "cache":                .25,
+		poolNodeLoadMaxDesc.String() + "cache,items":       30,
+		poolNodeLoadMinDesc.String() + "cache,items":       10,
+		poolNodeLoadStdDesc.String() + "cache,items":       10,
+		poolNodeLoadStdDesc.String() + "cache,connections": 0,
+	} {
+		if v, ok := have[k]; !ok || v != want {
+			t.Errorf("want %s %f, have %f", k, want, v)
+		}
+	}
+}
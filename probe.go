@@ -0,0 +1,232 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/cemir/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const subsystemProbe = "probe"
+
+var (
+	probeSuccessDesc    = newDesc(subsystemProbe, "success", "Whether the last probe succeeded.")
+	probeCanaryTTLDesc  = newDesc(subsystemProbe, "canary_ttl_seconds", "Remaining time to live of the canary key as read by the last meta probe.")
+	probeCanarySizeDesc = newDesc(subsystemProbe, "canary_size_bytes", "Size of the canary key as read by the last meta probe.")
+)
+
+const (
+	// probeSetGet sets, gets and deletes the canary key.
+	probeSetGet = "set_get"
+	// probeNoop sends the meta no-op command of memcached 1.6.
+	probeNoop = "noop"
+	// probeMeta sets, gets and deletes the canary key with meta commands.
+	probeMeta = "meta"
+)
+
+// ProbeOpts configures the synthetic probe.
+type ProbeOpts struct {
+	// Op is probeSetGet, the default, probeNoop or probeMeta.
+	Op string
+	// Key is the canary key which is written, read and deleted.
+	Key string
+	// TTL is the expiration time of the canary key, in case the delete fails.
+	TTL time.Duration
+	// Interval is the time between two probes. If zero, every scrape probes.
+	Interval time.Duration
+}
+
+// prober measures the latency of set, get and delete commands with a canary
+// key, or of a no-op command.
+type prober struct {
+	address string
+	timeout time.Duration
+	dialer  *Dialer
+	opts    ProbeOpts
+
+	duration *prometheus.HistogramVec
+
+	// probing serializes the probes, which share the canary key.
+	probing sync.Mutex
+
+	mu      sync.Mutex
+	success bool
+	probed  bool
+	// canary is the canary key as read by the last successful meta probe.
+	canary *metaItem
+}
+
+// newProber returns a prober. The dialer is used by the meta protocol probes,
+// set_get probes use the memcache client.
+func newProber(address string, timeout time.Duration, dialer *Dialer, opts ProbeOpts) *prober {
+	return &prober{
+		address: address,
+		timeout: timeout,
+		dialer:  dialer,
+		opts:    opts,
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: subsystemProbe,
+			Name:      "duration_seconds",
+			Help:      "Duration of the probe commands.",
+			Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+		}, []string{"op"}),
+	}
+}
+
+// run probes every interval. It never returns.
+func (p *prober) run() {
+	for {
+		p.probe()
+		time.Sleep(p.opts.Interval)
+	}
+}
+
+// probe runs the probe commands, records the result and returns the error of
+// a failed probe. Concurrent probes wait for each other.
+func (p *prober) probe() error {
+	p.probing.Lock()
+	defer p.probing.Unlock()
+
+	var err error
+	var canary *metaItem
+	switch p.opts.Op {
+	case probeNoop, probeMeta:
+		canary, err = p.metaCommands()
+	default:
+		err = p.commands()
+	}
+	if err != nil {
+		log.Errorf("Probe of %s failed: %s", p.address, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.success = err == nil
+	p.probed = true
+	p.canary = canary
+	return err
+}
+
+// metaCommands sends a no-op, or sets, gets and deletes the canary key with
+// meta commands. The read canary key is returned.
+func (p *prober) metaCommands() (*metaItem, error) {
+	c, err := p.dialer.meta(p.address, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer c.Close()
+
+	if p.opts.Op == probeNoop {
+		return nil, p.timed("noop", c.noop)
+	}
+
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := p.timed("set", func() error {
+		return c.set(p.opts.Key, value, p.opts.TTL)
+	}); err != nil {
+		return nil, err
+	}
+	var it *metaItem
+	if err := p.timed("get", func() (err error) {
+		it, err = c.get(p.opts.Key, "t", "s", "v")
+		return err
+	}); err != nil {
+		return nil, err
+	}
+	if it == nil || !bytes.Equal(it.Value, value) {
+		return nil, fmt.Errorf("canary key %q doesn't have the value %q", p.opts.Key, value)
+	}
+	return it, p.timed("delete", func() error {
+		return c.delete(p.opts.Key)
+	})
+}
+
+// commands sets, gets and deletes the canary key.
+func (p *prober) commands() error {
+	c, err := memcache.New(p.address)
+	if err != nil {
+		return err
+	}
+	c.Timeout = p.timeout
+
+	value := []byte(strconv.FormatInt(time.Now().UnixNano(), 10))
+	if err := p.timed("set", func() error {
+		return c.Set(&memcache.Item{Key: p.opts.Key, Value: value, Expiration: int32(p.opts.TTL.Seconds())})
+	}); err != nil {
+		return err
+	}
+	var it *memcache.Item
+	if err := p.timed("get", func() (err error) {
+		it, err = c.Get(p.opts.Key)
+		return err
+	}); err != nil {
+		return err
+	}
+	if !bytes.Equal(it.Value, value) {
+		return fmt.Errorf("got value %q for canary key %q, want %q", it.Value, p.opts.Key, value)
+	}
+	return p.timed("delete", func() error {
+		return c.Delete(p.opts.Key)
+	})
+}
+
+// timed runs a command and observes its duration.
+func (p *prober) timed(op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	p.duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		return fmt.Errorf("%s: %s", op, err)
+	}
+	return nil
+}
+
+func (p *prober) describe(ch chan<- *prometheus.Desc) {
+	ch <- probeSuccessDesc
+	ch <- probeCanaryTTLDesc
+	ch <- probeCanarySizeDesc
+	p.duration.Describe(ch)
+}
+
+func (p *prober) collect(ch chan<- prometheus.Metric) {
+	p.duration.Collect(ch)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.probed {
+		return
+	}
+	success := 0.
+	if p.success {
+		success = 1
+	}
+	ch <- prometheus.MustNewConstMetric(probeSuccessDesc, prometheus.GaugeValue, success)
+	if p.canary == nil {
+		return
+	}
+	if ttl, ok := p.canary.int('t'); ok {
+		ch <- prometheus.MustNewConstMetric(probeCanaryTTLDesc, prometheus.GaugeValue, float64(ttl))
+	}
+	if size, ok := p.canary.int('s'); ok {
+		ch <- prometheus.MustNewConstMetric(probeCanarySizeDesc, prometheus.GaugeValue, float64(size))
+	}
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// storageServer is a memcached stand-in supporting set, gets and delete, and
+// their meta command counterparts. If corrupt is set, gets return a different
+// value than stored.
+type storageServer struct {
+	mu      sync.Mutex
+	items   map[string][]byte
+	ttls    map[string]int
+	corrupt bool
+}
+
+func newStorageServer(t *testing.T) (*storageServer, string) {
+	s := &storageServer{items: map[string][]byte{}, ttls: map[string]int{}}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s, l.Addr().String()
+}
+
+func (s *storageServer) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 1 && f[0] == "mn" {
+			conn.Write([]byte("MN\r\n"))
+			continue
+		}
+		if len(f) < 2 {
+			conn.Write([]byte("ERROR\r\n"))
+			continue
+		}
+		s.mu.Lock()
+		switch f[0] {
+		case "ms":
+			n, _ := strconv.Atoi(f[2])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				s.mu.Unlock()
+				return
+			}
+			s.items[f[1]] = data[:n]
+			s.ttls[f[1]] = -1
+			for _, flag := range f[3:] {
+				if flag[0] == 'T' {
+					s.ttls[f[1]], _ = strconv.Atoi(flag[1:])
+				}
+			}
+			conn.Write([]byte("HD\r\n"))
+		case "mg":
+			v, ok := s.items[f[1]]
+			if !ok {
+				conn.Write([]byte("EN\r\n"))
+				break
+			}
+			var flags []string
+			value := false
+			for _, flag := range f[2:] {
+				switch flag {
+				case "t":
+					flags = append(flags, fmt.Sprintf("t%d", s.ttls[f[1]]))
+				case "s":
+					flags = append(flags, fmt.Sprintf("s%d", len(v)))
+				case "v":
+					value = true
+				}
+			}
+			if value {
+				if s.corrupt {
+					v = append([]byte("x"), v...)
+				}
+				fmt.Fprintf(conn, "VA %d %s\r\n%s\r\n", len(v), strings.Join(flags, " "), v)
+			} else {
+				fmt.Fprintf(conn, "HD %s\r\n", strings.Join(flags, " "))
+			}
+		case "md":
+			if _, ok := s.items[f[1]]; ok {
+				delete(s.items, f[1])
+				conn.Write([]byte("HD\r\n"))
+			} else {
+				conn.Write([]byte("NF\r\n"))
+			}
+		case "set":
+			n, _ := strconv.Atoi(f[4])
+			data := make([]byte, n+2)
+			if _, err := io.ReadFull(r, data); err != nil {
+				s.mu.Unlock()
+				return
+			}
+			s.items[f[1]] = data[:n]
+			s.ttls[f[1]], _ = strconv.Atoi(f[3])
+			conn.Write([]byte("STORED\r\n"))
+		case "gets", "get":
+			for _, k := range f[1:] {
+				if v, ok := s.items[k]; ok {
+					if s.corrupt {
+						v = append([]byte("x"), v...)
+					}
+					fmt.Fprintf(conn, "VALUE %s 0 %d 1\r\n%s\r\n", k, len(v), v)
+				}
+			}
+			conn.Write([]byte("END\r\n"))
+		case "delete":
+			if _, ok := s.items[f[1]]; ok {
+				delete(s.items, f[1])
+				conn.Write([]byte("DELETED\r\n"))
+			} else {
+				conn.Write([]byte("NOT_FOUND\r\n"))
+			}
+		default:
+			conn.Write([]byte("ERROR\r\n"))
+		}
+		s.mu.Unlock()
+	}
+}
+
+func TestProber(t *testing.T) {
+	s, addr := newStorageServer(t)
+	p := newProber(addr, time.Second, nil, ProbeOpts{Key: "canary", TTL: time.Minute})
+
+	success := func() float64 {
+		ch := make(chan prometheus.Metric, 10)
+		p.collect(ch)
+		close(ch)
+		for m := range ch {
+			if m.Desc() == probeSuccessDesc {
+				var pb dto.Metric
+				m.Write(&pb)
+				return pb.GetGauge().GetValue()
+			}
+		}
+		t.Fatal("no probe success metric")
+		return 0
+	}
+
+	p.probe()
+	if v := success(); v != 1 {
+		t.Errorf("want successful probe, have %f", v)
+	}
+	s.mu.Lock()
+	if len(s.items) != 0 {
+		t.Errorf("want canary key deleted, have %v", s.items)
+	}
+	s.corrupt = true
+	s.mu.Unlock()
+
+	for _, op := range []string{"set", "get", "delete"} {
+		var pb dto.Metric
+		p.duration.WithLabelValues(op).(prometheus.Metric).Write(&pb)
+		if n := pb.GetHistogram().GetSampleCount(); n != 1 {
+			t.Errorf("want 1 %s observation, have %d", op, n)
+		}
+	}
+
+	p.probe()
+	if v := success(); v != 0 {
+		t.Errorf("want failed probe for a wrong value, have %f", v)
+	}
+}
+
+func TestProberConcurrent(t *testing.T) {
+	_, addr := newStorageServer(t)
+	for _, op := range []string{probeSetGet, probeMeta} {
+		p := newProber(addr, time.Second, nil, ProbeOpts{Op: op, Key: "canary", TTL: time.Minute})
+		errs := make(chan error, 10)
+		for i := 0; i < cap(errs); i++ {
+			go func() {
+				errs <- p.probe()
+			}()
+		}
+		for i := 0; i < cap(errs); i++ {
+			if err := <-errs; err != nil {
+				t.Errorf("want concurrent %s probes to succeed, have %s", op, err)
+			}
+		}
+	}
+}
+
+func TestProberMeta(t *testing.T) {
+	_, addr := newStorageServer(t)
+	p := newProber(addr, time.Second, nil, ProbeOpts{Op: probeMeta, Key: "canary", TTL: time.Minute})
+	p.probe()
+
+	ch := make(chan prometheus.Metric, 10)
+	p.collect(ch)
+	close(ch)
+	have := map[*prometheus.Desc]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		have[m.Desc()] = pb.GetGauge().GetValue()
+	}
+	if have[probeSuccessDesc] != 1 || have[probeCanaryTTLDesc] != 60 || have[probeCanarySizeDesc] != 19 {
+		t.Errorf("unexpected probe metrics %v", have)
+	}
+
+	p = newProber(addr, time.Second, nil, ProbeOpts{Op: probeNoop})
+	p.probe()
+	if !p.success || p.canary != nil {
+		t.Errorf("want successful no-op probe without canary, have %v %v", p.success, p.canary)
+	}
+}
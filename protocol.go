@@ -0,0 +1,381 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/cemir/gomemcache/memcache"
+)
+
+// The memcache client only knows the commands needed by its users. The
+// commands below are spoken directly over the text protocol.
+
+// dial connects to a memcached server. Addresses containing a slash are
+// unix sockets, like in the memcache client.
+func dial(address string, timeout time.Duration) (net.Conn, error) {
+	return (*Dialer)(nil).dial(address, timeout)
+}
+
+// Dialer configures the connections to servers which need TLS or
+// authentication. The memcache client doesn't support either, so the commands
+// run on scrape are spoken directly over the text protocol when a Dialer is
+// set. A nil Dialer opens plain connections.
+type Dialer struct {
+	TLS *tls.Config
+	// Username and Password are sent with the ASCII authentication of
+	// memcached 1.5.15 and later if set.
+	Username, Password string
+}
+
+func (d *Dialer) dial(address string, timeout time.Duration) (net.Conn, error) {
+	network := "tcp"
+	if strings.Contains(address, "/") {
+		network = "unix"
+	}
+	if d == nil {
+		return net.DialTimeout(network, address, timeout)
+	}
+
+	var conn net.Conn
+	var err error
+	if d.TLS != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, network, address, d.TLS)
+	} else {
+		conn, err = net.DialTimeout(network, address, timeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if d.Username != "" {
+		if err := d.authenticate(conn, timeout); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// authenticate sends the credentials as the value of a set command, which is
+// how ASCII authentication works.
+func (d *Dialer) authenticate(conn net.Conn, timeout time.Duration) error {
+	conn.SetDeadline(time.Now().Add(timeout))
+	defer conn.SetDeadline(time.Time{})
+
+	creds := d.Username + " " + d.Password
+	if _, err := fmt.Fprintf(conn, "set auth 0 0 %d\r\n%s\r\n", len(creds), creds); err != nil {
+		return err
+	}
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimRight(line, "\r\n"); line != "STORED" {
+		if err := protocolError(line); err != nil {
+			return fmt.Errorf("authentication failed: %s", err)
+		}
+		return fmt.Errorf("unexpected authentication response %q", line)
+	}
+	return nil
+}
+
+// statsCommand runs `stats <args>` and returns the reported stats.
+func statsCommand(address string, timeout time.Duration, args string) (map[string]string, error) {
+	return (*Dialer)(nil).stats(address, timeout, args)
+}
+
+// stats runs `stats <args>`, or plain `stats` without args, and returns the
+// reported stats.
+func (d *Dialer) stats(address string, timeout time.Duration, args string) (map[string]string, error) {
+	conn, err := d.dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "%s\r\n", strings.TrimSpace("stats "+args)); err != nil {
+		return nil, err
+	}
+
+	stats := map[string]string{}
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "END" {
+			return stats, nil
+		}
+		if err := protocolError(line); err != nil {
+			return nil, err
+		}
+		f := strings.SplitN(line, " ", 3)
+		if len(f) != 3 || f[0] != "STAT" {
+			return nil, fmt.Errorf("unexpected stats line %q", line)
+		}
+		stats[f[1]] = f[2]
+	}
+}
+
+// serverStats returns the general, slab and item stats like the Stats method
+// of the memcache client.
+func (d *Dialer) serverStats(address string, timeout time.Duration) (memcache.Stats, error) {
+	st := memcache.Stats{Slabs: map[int]map[string]string{}, Items: map[int]map[string]string{}}
+	var err error
+	if st.Stats, err = d.stats(address, timeout, ""); err != nil {
+		return st, err
+	}
+	for _, args := range []string{"slabs", "items"} {
+		stats, err := d.stats(address, timeout, args)
+		if err != nil {
+			return st, err
+		}
+		for k, v := range stats {
+			// Slab stats look like "1:chunk_size", item stats like
+			// "items:1:number". Totals of `stats slabs` have no class and
+			// are general stats.
+			f := strings.Split(k, ":")
+			target := st.Slabs
+			switch len(f) {
+			case 1:
+				st.Stats[k] = v
+				continue
+			case 3:
+				target, f = st.Items, f[1:]
+			}
+			class, err := strconv.Atoi(f[0])
+			if err != nil {
+				return st, fmt.Errorf("unexpected %s stat %q", args, k)
+			}
+			if target[class] == nil {
+				target[class] = map[string]string{}
+			}
+			target[class][f[1]] = v
+		}
+	}
+	return st, nil
+}
+
+// serverAddr is the address of a server as net.Addr.
+type serverAddr string
+
+func (a serverAddr) Network() string {
+	if strings.Contains(string(a), "/") {
+		return "unix"
+	}
+	return "tcp"
+}
+
+func (a serverAddr) String() string { return string(a) }
+
+// dialerClient implements statsClient over connections of a Dialer.
+type dialerClient struct {
+	dialer  *Dialer
+	address string
+	timeout time.Duration
+}
+
+func (c *dialerClient) Stats() (map[net.Addr]memcache.Stats, error) {
+	st, err := c.dialer.serverStats(c.address, c.timeout)
+	if err != nil {
+		return nil, err
+	}
+	return map[net.Addr]memcache.Stats{serverAddr(c.address): st}, nil
+}
+
+func (c *dialerClient) StatsSettings() (map[net.Addr]map[string]string, error) {
+	settings, err := c.dialer.stats(c.address, c.timeout, "settings")
+	if err != nil {
+		return nil, err
+	}
+	return map[net.Addr]map[string]string{serverAddr(c.address): settings}, nil
+}
+
+// protocolError returns an error if the line is an error response.
+func protocolError(line string) error {
+	switch {
+	case line == "ERROR":
+		return fmt.Errorf("memcached: unknown command")
+	case strings.HasPrefix(line, "CLIENT_ERROR "), strings.HasPrefix(line, "SERVER_ERROR "):
+		return fmt.Errorf("memcached: %s", line)
+	}
+	return nil
+}
+
+// metadumpItem is a line of `lru_crawler metadump`.
+type metadumpItem struct {
+	key string
+	// exp is the expiration time as unix timestamp, or -1 if the item never
+	// expires.
+	exp int64
+	// lastAccess is the time of the last access as unix timestamp.
+	lastAccess int64
+	fetched    bool
+	class      int
+	size       int64
+}
+
+// parseMetadumpLine parses a line like
+// "key=foo exp=-1 la=1560000000 cas=2 fetch=no cls=1 size=68".
+func parseMetadumpLine(line string) (metadumpItem, error) {
+	var it metadumpItem
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			return it, fmt.Errorf("unexpected metadump field %q", field)
+		}
+		var err error
+		switch kv[0] {
+		case "key":
+			it.key, err = url.QueryUnescape(kv[1])
+		case "exp":
+			it.exp, err = strconv.ParseInt(kv[1], 10, 64)
+		case "la":
+			it.lastAccess, err = strconv.ParseInt(kv[1], 10, 64)
+		case "fetch":
+			it.fetched = kv[1] == "yes"
+		case "cls":
+			it.class, err = strconv.Atoi(kv[1])
+		case "size":
+			it.size, err = strconv.ParseInt(kv[1], 10, 64)
+		}
+		if err != nil {
+			return it, fmt.Errorf("invalid metadump field %q: %s", field, err)
+		}
+	}
+	if it.key == "" {
+		return it, fmt.Errorf("metadump line without key %q", line)
+	}
+	return it, nil
+}
+
+// getMulti gets keys with a single get command and returns the values of the
+// stored ones.
+func (d *Dialer) getMulti(address string, timeout time.Duration, keys []string) (map[string][]byte, error) {
+	values := map[string][]byte{}
+	if len(keys) == 0 {
+		return values, nil
+	}
+	conn, err := d.dial(address, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "get %s\r\n", strings.Join(keys, " ")); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "END" {
+			return values, nil
+		}
+		if err := protocolError(line); err != nil {
+			return nil, err
+		}
+		// VALUE <key> <flags> <bytes> [<cas>]
+		f := strings.Fields(line)
+		if len(f) < 4 || f[0] != "VALUE" {
+			return nil, fmt.Errorf("unexpected get line %q", line)
+		}
+		size, err := strconv.Atoi(f[3])
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("unexpected get line %q", line)
+		}
+		value := make([]byte, size+2)
+		if _, err := io.ReadFull(r, value); err != nil {
+			return nil, err
+		}
+		values[f[1]] = value[:size]
+	}
+}
+
+// metadump runs `lru_crawler metadump <classes>` and calls fn for every item.
+// The whole dump has to finish within timeout.
+func (d *Dialer) metadump(address string, timeout time.Duration, classes string, fn func(metadumpItem)) error {
+	conn, err := d.dial(address, timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := fmt.Fprintf(conn, "lru_crawler metadump %s\r\n", classes); err != nil {
+		return err
+	}
+
+	r := bufio.NewReader(conn)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if line == "END" {
+			return nil
+		}
+		if strings.HasPrefix(line, "BUSY") {
+			return fmt.Errorf("memcached: %s", line)
+		}
+		if err := protocolError(line); err != nil {
+			return err
+		}
+		it, err := parseMetadumpLine(line)
+		if err != nil {
+			return err
+		}
+		fn(it)
+	}
+}
+
+// sampleMetadump runs a metadump and returns up to size items sampled
+// uniformly over the whole dump, and the number of dumped items. Metadump
+// walks the slab classes in order, so the first items aren't a sample. All
+// items are returned if size isn't positive.
+func (d *Dialer) sampleMetadump(address string, timeout time.Duration, classes string, size int) ([]metadumpItem, int, error) {
+	var (
+		sample []metadumpItem
+		n      int
+	)
+	err := d.metadump(address, timeout, classes, func(it metadumpItem) {
+		n++
+		// Reservoir sampling: the n-th item replaces a sampled one with
+		// probability size/n.
+		if size <= 0 || len(sample) < size {
+			sample = append(sample, it)
+		} else if i := rand.Intn(n); i < size {
+			sample[i] = it
+		}
+	})
+	return sample, n, err
+}
@@ -0,0 +1,119 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeServer answers each request line with the response of the first
+// matching command prefix. It returns the address of the server.
+func fakeServer(t *testing.T, responses map[string]string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				r := bufio.NewReader(conn)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					resp := "ERROR\r\n"
+					for prefix, v := range responses {
+						if strings.HasPrefix(line, prefix) {
+							resp = v
+							break
+						}
+					}
+					conn.Write([]byte(resp))
+				}
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestStatsCommand(t *testing.T) {
+	addr := fakeServer(t, map[string]string{
+		"stats sizes": "STAT sizes_status enabled\r\nSTAT 96 3\r\nEND\r\n",
+	})
+
+	stats, err := statsCommand(addr, time.Second, "sizes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["sizes_status"] != "enabled" || stats["96"] != "3" {
+		t.Errorf("unexpected stats %v", stats)
+	}
+
+	if _, err := statsCommand(addr, time.Second, "unknown"); err == nil {
+		t.Error("want error for unknown command")
+	}
+}
+
+func TestGetMulti(t *testing.T) {
+	addr := fakeServer(t, map[string]string{
+		"get a b c\r\n": "VALUE a 0 3\r\nfoo\r\nVALUE c 1 5 7\r\nb\r\nar\r\nEND\r\n",
+	})
+
+	values, err := (*Dialer)(nil).getMulti(addr, time.Second, []string{"a", "b", "c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]byte{"a": []byte("foo"), "c": []byte("b\r\nar")}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("want %q, have %q", want, values)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	addr := fakeServer(t, map[string]string{
+		// The credentials are sent as value of the set command.
+		"set auth 0 0 11": "STORED\r\n",
+		"user secret":     "",
+		"stats\r\n":       "STAT pid 1\r\nSTAT version 1.6.9\r\nEND\r\n",
+		"stats slabs":     "STAT 1:chunk_size 96\r\nSTAT active_slabs 1\r\nEND\r\n",
+		"stats items":     "STAT items:1:number 5\r\nEND\r\n",
+	})
+	d := &Dialer{Username: "user", Password: "secret"}
+
+	st, err := d.serverStats(addr, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Stats["version"] != "1.6.9" || st.Stats["active_slabs"] != "1" {
+		t.Errorf("unexpected general stats %v", st.Stats)
+	}
+	if st.Slabs[1]["chunk_size"] != "96" || st.Items[1]["number"] != "5" {
+		t.Errorf("unexpected slab stats %v and item stats %v", st.Slabs, st.Items)
+	}
+	d.Password = "wrong"
+	if _, err := d.serverStats(addr, time.Second); err == nil {
+		t.Error("want error for failed authentication")
+	}
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const subsystemReplica = "replica"
+
+var (
+	replicaDivergenceDesc = newDesc(subsystemReplica, "divergence_ratio", "Ratio of the sampled keys which are missing on a replica or differ between replicas.", "pool")
+	replicaCheckedDesc    = newDesc(subsystemReplica, "checked_keys", "Number of sampled keys stored on at least one replica in the last check.", "pool")
+	replicaMissingDesc    = newDesc(subsystemReplica, "missing_keys", "Number of sampled keys missing on this replica but stored on another one.", "pool", "server")
+	replicaLastCheckDesc  = newDesc(subsystemReplica, "last_check_timestamp_seconds", "Time of the last successful consistency check.", "pool")
+)
+
+// replicaCheck is the result of a consistency check.
+type replicaCheck struct {
+	checked, diverged float64
+	missing           map[string]float64
+	time              time.Time
+}
+
+// replicaChecker periodically samples keys and compares them across the
+// replicas of pools. Keys are sampled from a metadump of the first replica
+// unless a pool configures the keys to check.
+type replicaChecker struct {
+	pools []*Pool
+
+	mu   sync.Mutex
+	last map[string]*replicaCheck
+	// source is the index of the server of a pool which is sampled next.
+	source map[string]int
+}
+
+func newReplicaChecker(pools []*Pool) *replicaChecker {
+	return &replicaChecker{pools: pools, last: map[string]*replicaCheck{}, source: map[string]int{}}
+}
+
+// run starts checking every pool in its interval.
+func (r *replicaChecker) run() {
+	for _, p := range r.pools {
+		go func(p *Pool) {
+			for {
+				if err := r.update(p); err != nil {
+					log.Errorf("Failed to check consistency of pool %s: %s", p.Name, err)
+				}
+				time.Sleep(p.Consistency.Interval)
+			}
+		}(p)
+	}
+}
+
+// sampleKeys returns the keys to check in a pool. Keys are sampled over the
+// whole metadump of one server, and the sampled server rotates between checks
+// so that keys missing on some servers are found as well.
+func (r *replicaChecker) sampleKeys(p *Pool) ([]string, error) {
+	c := p.Consistency
+	if len(c.Keys) > 0 {
+		return c.Keys, nil
+	}
+	servers := p.servers()
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no servers")
+	}
+	r.mu.Lock()
+	server := servers[r.source[p.Name]%len(servers)]
+	r.source[p.Name]++
+	r.mu.Unlock()
+
+	items, _, err := p.dialer.sampleMetadump(server, c.Timeout, "all", c.SampleSize)
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, len(items))
+	for i, it := range items {
+		keys[i] = it.key
+	}
+	return keys, nil
+}
+
+// update checks a pool and replaces its last result on success.
+func (r *replicaChecker) update(p *Pool) error {
+	keys, err := r.sampleKeys(p)
+	if err != nil {
+		return err
+	}
+	servers := p.servers()
+
+	// hashes holds the value hashes of every key per replica.
+	hashes := make([]map[string]uint64, len(servers))
+	for i, server := range servers {
+		values, err := p.dialer.getMulti(server, p.Consistency.Timeout, keys)
+		if err != nil {
+			return err
+		}
+		hashes[i] = map[string]uint64{}
+		for k, v := range values {
+			h := fnv.New64a()
+			h.Write(v)
+			hashes[i][k] = h.Sum64()
+		}
+	}
+
+	check := &replicaCheck{missing: map[string]float64{}, time: time.Now()}
+	for _, server := range servers {
+		check.missing[server] = 0
+	}
+	for _, k := range keys {
+		var (
+			stored, differs bool
+			first           uint64
+		)
+		for _, h := range hashes {
+			v, ok := h[k]
+			if !ok {
+				continue
+			}
+			if stored && v != first {
+				differs = true
+			}
+			stored, first = true, v
+		}
+		if !stored {
+			// Expired or evicted everywhere since it was sampled.
+			continue
+		}
+		check.checked++
+		for i, h := range hashes {
+			if _, ok := h[k]; !ok {
+				check.missing[servers[i]]++
+				differs = true
+			}
+		}
+		if differs {
+			check.diverged++
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.last[p.Name] = check
+	return nil
+}
+
+// Describe implements prometheus.Collector.
+func (r *replicaChecker) Describe(ch chan<- *prometheus.Desc) {
+	ch <- replicaDivergenceDesc
+	ch <- replicaCheckedDesc
+	ch <- replicaMissingDesc
+	ch <- replicaLastCheckDesc
+}
+
+// Collect implements prometheus.Collector.
+func (r *replicaChecker) Collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for pool, c := range r.last {
+		if c.checked > 0 {
+			ch <- prometheus.MustNewConstMetric(replicaDivergenceDesc, prometheus.GaugeValue, c.diverged/c.checked, pool)
+		}
+		ch <- prometheus.MustNewConstMetric(replicaCheckedDesc, prometheus.GaugeValue, c.checked, pool)
+		for server, n := range c.missing {
+			ch <- prometheus.MustNewConstMetric(replicaMissingDesc, prometheus.GaugeValue, n, pool, server)
+		}
+		ch <- prometheus.MustNewConstMetric(replicaLastCheckDesc, prometheus.GaugeValue, float64(c.time.UnixNano())/1e9, pool)
+	}
+}
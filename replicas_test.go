@@ -0,0 +1,85 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReplicaChecker(t *testing.T) {
+	var (
+		servers []*storageServer
+		addrs   []string
+	)
+	for i := 0; i < 3; i++ {
+		s, addr := newStorageServer(t)
+		servers = append(servers, s)
+		addrs = append(addrs, addr)
+	}
+	for _, s := range servers {
+		s.items["same"] = []byte("v")
+		s.items["stale"] = []byte("v1")
+	}
+	servers[1].items["stale"] = []byte("v2")
+	servers[0].items["lost"] = []byte("v")
+	servers[1].items["lost"] = []byte("v")
+
+	pool := &Pool{
+		Name:        "sessions",
+		Servers:     addrs,
+		Consistency: &ConsistencyCheck{Keys: []string{"same", "stale", "lost", "gone"}},
+	}
+	if err := pool.init(); err != nil {
+		t.Fatal(err)
+	}
+	r := newReplicaChecker([]*Pool{pool})
+	if err := r.update(pool); err != nil {
+		t.Fatal(err)
+	}
+
+	c := r.last["sessions"]
+	if c.checked != 3 || c.diverged != 2 {
+		t.Errorf("want 2 of 3 keys diverged, have %d of %d", int(c.diverged), int(c.checked))
+	}
+	for i, want := range []float64{0, 0, 1} {
+		if c.missing[addrs[i]] != want {
+			t.Errorf("want %f keys missing on replica %d, have %f", want, i, c.missing[addrs[i]])
+		}
+	}
+	if time.Since(c.time) > time.Minute {
+		t.Errorf("unexpected check time %s", c.time)
+	}
+}
+
+func TestReplicaSampleKeys(t *testing.T) {
+	a := fakeServer(t, map[string]string{"lru_crawler metadump all": "key=a exp=-1 la=1560000000 cas=1 fetch=no cls=1 size=60\r\nEND\r\n"})
+	b := fakeServer(t, map[string]string{"lru_crawler metadump all": "key=b exp=-1 la=1560000000 cas=1 fetch=no cls=1 size=60\r\nEND\r\n"})
+	pool := &Pool{Name: "sessions", Servers: []string{a, b}, Consistency: &ConsistencyCheck{}}
+	if err := pool.init(); err != nil {
+		t.Fatal(err)
+	}
+	r := newReplicaChecker([]*Pool{pool})
+
+	// The sampled server rotates between checks.
+	for _, want := range []string{"a", "b", "a"} {
+		keys, err := r.sampleKeys(pool)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(keys) != 1 || keys[0] != want {
+			t.Errorf("want keys [%s], have %v", want, keys)
+		}
+	}
+}
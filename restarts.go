@@ -0,0 +1,116 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// resetCounters are stats which are set back to zero by `stats reset`.
+var resetCounters = []string{
+	"cmd_get",
+	"cmd_set",
+	"get_hits",
+	"get_misses",
+	"bytes_read",
+	"bytes_written",
+	"total_items",
+	"evictions",
+}
+
+// observedStats is the state of a server at its last scrape.
+type observedStats struct {
+	pid      string
+	uptime   float64
+	counters map[string]float64
+}
+
+// restartTracker detects server restarts and stats resets by comparing the
+// stats of a server with the ones of the previous scrape.
+type restartTracker struct {
+	mu   sync.Mutex
+	last map[string]observedStats
+
+	restarts prometheus.Counter
+	resets   prometheus.Counter
+}
+
+func newRestartTracker() *restartTracker {
+	return &restartTracker{
+		last: map[string]observedStats{},
+		restarts: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "restarts_observed_total",
+			Help:      "Number of server restarts observed between scrapes.",
+		}),
+		resets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "stats_resets_observed_total",
+			Help:      "Number of stats resets observed between scrapes.",
+		}),
+	}
+}
+
+// observe compares the stats of the server at addr with the previous ones.
+// A changed pid or a decreased uptime is a restart. Counters which went
+// backwards while the uptime kept growing are a stats reset.
+func (r *restartTracker) observe(addr string, stats map[string]string) {
+	cur := observedStats{
+		pid:      stats["pid"],
+		counters: map[string]float64{},
+	}
+	uptime, err := strconv.ParseFloat(stats["uptime"], 64)
+	if err != nil {
+		return
+	}
+	cur.uptime = uptime
+	for _, key := range resetCounters {
+		if v, err := strconv.ParseFloat(stats[key], 64); err == nil {
+			cur.counters[key] = v
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	last, ok := r.last[addr]
+	r.last[addr] = cur
+	if !ok {
+		return
+	}
+
+	if cur.pid != last.pid || cur.uptime < last.uptime {
+		r.restarts.Inc()
+		return
+	}
+	for key, v := range cur.counters {
+		if l, ok := last.counters[key]; ok && v < l {
+			r.resets.Inc()
+			return
+		}
+	}
+}
+
+func (r *restartTracker) describe(ch chan<- *prometheus.Desc) {
+	r.restarts.Describe(ch)
+	r.resets.Describe(ch)
+}
+
+func (r *restartTracker) collect(ch chan<- prometheus.Metric) {
+	r.restarts.Collect(ch)
+	r.resets.Collect(ch)
+}
@@ -0,0 +1,56 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func counterValue(t *testing.T, c prometheus.Counter) float64 {
+	var pb dto.Metric
+	if err := c.Write(&pb); err != nil {
+		t.Fatal(err)
+	}
+	return pb.GetCounter().GetValue()
+}
+
+func TestRestartTracker(t *testing.T) {
+	r := newRestartTracker()
+
+	scrapes := []struct {
+		stats            map[string]string
+		restarts, resets float64
+	}{
+		{map[string]string{"pid": "10", "uptime": "100", "cmd_get": "50"}, 0, 0},
+		{map[string]string{"pid": "10", "uptime": "110", "cmd_get": "60"}, 0, 0},
+		// stats reset: same process, counters went backwards.
+		{map[string]string{"pid": "10", "uptime": "120", "cmd_get": "2"}, 0, 1},
+		// restart: new process.
+		{map[string]string{"pid": "42", "uptime": "5", "cmd_get": "0"}, 1, 1},
+		// restart with a reused pid: uptime went backwards.
+		{map[string]string{"pid": "42", "uptime": "3", "cmd_get": "0"}, 2, 1},
+	}
+	for i, s := range scrapes {
+		r.observe("localhost:11211", s.stats)
+		if have := counterValue(t, r.restarts); have != s.restarts {
+			t.Errorf("scrape %d: want %v restarts, have %v", i, s.restarts, have)
+		}
+		if have := counterValue(t, r.resets); have != s.resets {
+			t.Errorf("scrape %d: want %v resets, have %v", i, s.resets, have)
+		}
+	}
+}
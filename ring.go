@@ -0,0 +1,365 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"hash/fnv"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cemir/gomemcache/memcache"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+// Hash algorithms of client side sharded pools.
+const (
+	hashModulo = "modulo"
+	hashKetama = "ketama"
+	hashJump   = "jump"
+
+	// ketamaPointsPerServer is the average number of md5 digests per server.
+	// Every digest adds four points to the ring.
+	ketamaPointsPerServer = 40
+	// shareSampleKeys is the number of keys hashed to estimate the keyspace
+	// share of the servers.
+	shareSampleKeys = 100000
+	// ringRateInterval is the interval the get rates of the servers are
+	// measured over, independently of the scrapes.
+	ringRateInterval = time.Minute
+)
+
+var (
+	poolKeyspaceShareDesc = newDesc("pool", "keyspace_share", "Share of the keyspace the server owns according to the hash algorithm of the pool.", "pool", "server")
+	poolImbalanceDesc     = newDesc("pool", "load_imbalance_ratio", "Highest ratio of a server's share of the load metric to its keyspace share.", "pool", "metric")
+)
+
+// newSelector returns the memcache.ServerSelector of a pool. Weights default
+// to 1.
+func newSelector(algorithm string, servers []string, weights map[string]int) (memcache.ServerSelector, error) {
+	// Weighted servers are repeated, like in memcache.ServerList.
+	var buckets []net.Addr
+	for _, s := range servers {
+		w, ok := weights[s]
+		if !ok {
+			w = 1
+		}
+		for i := 0; i < w; i++ {
+			buckets = append(buckets, serverAddr(s))
+		}
+	}
+	if len(buckets) == 0 {
+		return nil, fmt.Errorf("no servers with a positive weight")
+	}
+	switch algorithm {
+	case "", hashModulo:
+		return moduloSelector(buckets), nil
+	case hashJump:
+		return jumpSelector(buckets), nil
+	case hashKetama:
+		return newKetamaSelector(servers, weights), nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %q", algorithm)
+}
+
+// moduloSelector picks servers by crc32 modulo, like memcache.ServerList.
+type moduloSelector []net.Addr
+
+func (s moduloSelector) PickServer(key string) (net.Addr, error) {
+	return s[crc32.ChecksumIEEE([]byte(key))%uint32(len(s))], nil
+}
+
+func (s moduloSelector) Each(f func(net.Addr) error) error {
+	return eachUnique(s, f)
+}
+
+// jumpSelector picks servers with the jump consistent hash of Lamping and
+// Veach on the 64 bit FNV-1a hash of the key.
+type jumpSelector []net.Addr
+
+func (s jumpSelector) PickServer(key string) (net.Addr, error) {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	k := h.Sum64()
+	var b, j int64 = -1, 0
+	for j < int64(len(s)) {
+		b = j
+		k = k*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((k>>33)+1)))
+	}
+	return s[b], nil
+}
+
+func (s jumpSelector) Each(f func(net.Addr) error) error {
+	return eachUnique(s, f)
+}
+
+func eachUnique(addrs []net.Addr, f func(net.Addr) error) error {
+	seen := map[net.Addr]bool{}
+	for _, a := range addrs {
+		if seen[a] {
+			continue
+		}
+		seen[a] = true
+		if err := f(a); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ketamaSelector is the continuum of libketama: every server gets points on a
+// 32 bit ring from the md5 digests of "<server>-<i>", and keys belong to the
+// next point of the md5 of the key.
+type ketamaSelector struct {
+	points []uint32
+	addrs  map[uint32]net.Addr
+	all    []net.Addr
+}
+
+// newKetamaSelector allocates the points like ketama_create_continuum: a
+// server with weight w out of a total weight gets
+// floorf(w/total * 40 * len(servers)) digests, in single precision.
+func newKetamaSelector(servers []string, weights map[string]int) *ketamaSelector {
+	k := &ketamaSelector{addrs: map[uint32]net.Addr{}}
+	weight := func(s string) int {
+		if w, ok := weights[s]; ok {
+			return w
+		}
+		return 1
+	}
+	total := 0
+	for _, s := range servers {
+		total += weight(s)
+	}
+	for _, s := range servers {
+		pct := float32(weight(s)) / float32(total)
+		digests := int(math.Floor(float64(float32(float64(pct) * ketamaPointsPerServer * float64(float32(len(servers)))))))
+		if digests <= 0 {
+			continue
+		}
+		k.all = append(k.all, serverAddr(s))
+		for i := 0; i < digests; i++ {
+			d := md5.Sum([]byte(s + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				p := binary.LittleEndian.Uint32(d[4*j:])
+				k.points = append(k.points, p)
+				k.addrs[p] = serverAddr(s)
+			}
+		}
+	}
+	sort.Slice(k.points, func(i, j int) bool { return k.points[i] < k.points[j] })
+	return k
+}
+
+func (k *ketamaSelector) PickServer(key string) (net.Addr, error) {
+	d := md5.Sum([]byte(key))
+	h := binary.LittleEndian.Uint32(d[:4])
+	i := sort.Search(len(k.points), func(i int) bool { return k.points[i] >= h })
+	if i == len(k.points) {
+		i = 0
+	}
+	return k.addrs[k.points[i]], nil
+}
+
+func (k *ketamaSelector) Each(f func(net.Addr) error) error {
+	return eachUnique(k.all, f)
+}
+
+// keyspaceShares estimates the share of the keyspace every server owns by
+// picking the servers of sample keys.
+func keyspaceShares(s memcache.ServerSelector) (map[string]float64, error) {
+	shares := map[string]float64{}
+	s.Each(func(a net.Addr) error {
+		shares[a.String()] = 0
+		return nil
+	})
+	for i := 0; i < shareSampleKeys; i++ {
+		a, err := s.PickServer("key:" + strconv.Itoa(i))
+		if err != nil {
+			return nil, err
+		}
+		shares[a.String()] += 1. / shareSampleKeys
+	}
+	return shares, nil
+}
+
+// ringLoad is the last measured cmd_get counter of a server.
+type ringLoad struct {
+	gets float64
+	time time.Time
+}
+
+// ringShares are the keyspace shares of the servers of a pool.
+type ringShares struct {
+	servers string
+	shares  map[string]float64
+}
+
+// ringAnalyzer compares the keyspace shares of the servers of sharded pools
+// with their observed items and bytes on every scrape, and with their get
+// rates measured every ringRateInterval in the background. Rates between
+// scrapes would depend on how many Prometheus servers scrape the exporter.
+type ringAnalyzer struct {
+	pools   []*Pool
+	timeout time.Duration
+
+	mu     sync.Mutex
+	shares map[string]*ringShares
+	last   map[string]ringLoad
+	rates  map[string]float64
+}
+
+func newRingAnalyzer(pools []*Pool, timeout time.Duration) *ringAnalyzer {
+	return &ringAnalyzer{
+		pools:   pools,
+		timeout: timeout,
+		shares:  map[string]*ringShares{},
+		last:    map[string]ringLoad{},
+		rates:   map[string]float64{},
+	}
+}
+
+// run measures the get rates every ringRateInterval. It never returns.
+func (r *ringAnalyzer) run() {
+	for {
+		for _, p := range r.pools {
+			for _, server := range p.servers() {
+				stats, err := p.dialer.stats(server, r.timeout, "")
+				if err != nil {
+					log.Errorf("Failed to collect stats of %s in pool %s: %s", server, p.Name, err)
+					r.mu.Lock()
+					delete(r.rates, server)
+					r.mu.Unlock()
+					continue
+				}
+				r.observeGets(server, stats["cmd_get"], time.Now())
+			}
+		}
+		time.Sleep(ringRateInterval)
+	}
+}
+
+// poolShares returns the keyspace shares of a pool. They are only estimated
+// again if the servers of the pool changed.
+func (r *ringAnalyzer) poolShares(p *Pool) (map[string]float64, error) {
+	servers := p.servers()
+	key := strings.Join(servers, ",")
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if s, ok := r.shares[p.Name]; ok && s.servers == key {
+		return s.shares, nil
+	}
+	selector, err := newSelector(p.Hash, servers, p.Weights)
+	if err != nil {
+		return nil, err
+	}
+	shares, err := keyspaceShares(selector)
+	if err != nil {
+		return nil, err
+	}
+	r.shares[p.Name] = &ringShares{servers: key, shares: shares}
+	return shares, nil
+}
+
+// Describe implements prometheus.Collector.
+func (r *ringAnalyzer) Describe(ch chan<- *prometheus.Desc) {
+	ch <- poolKeyspaceShareDesc
+	ch <- poolImbalanceDesc
+}
+
+// Collect implements prometheus.Collector.
+func (r *ringAnalyzer) Collect(ch chan<- prometheus.Metric) {
+	for _, p := range r.pools {
+		shares, err := r.poolShares(p)
+		if err != nil {
+			log.Errorf("Failed to estimate the keyspace shares of pool %s: %s", p.Name, err)
+			continue
+		}
+		loads := map[string]map[string]float64{"items": {}, "bytes": {}, "gets": {}}
+		for server, share := range shares {
+			ch <- prometheus.MustNewConstMetric(poolKeyspaceShareDesc, prometheus.GaugeValue, share, p.Name, server)
+
+			stats, err := p.dialer.stats(server, r.timeout, "")
+			if err != nil {
+				log.Errorf("Failed to collect stats of %s in pool %s: %s", server, p.Name, err)
+				continue
+			}
+			loads["items"][server], _ = strconv.ParseFloat(stats["curr_items"], 64)
+			loads["bytes"][server], _ = strconv.ParseFloat(stats["bytes"], 64)
+			r.mu.Lock()
+			if rate, ok := r.rates[server]; ok {
+				loads["gets"][server] = rate
+			}
+			r.mu.Unlock()
+		}
+		for metric, load := range loads {
+			// Only compare complete pools.
+			if len(load) != len(shares) {
+				continue
+			}
+			if ratio, ok := imbalance(load, shares); ok {
+				ch <- prometheus.MustNewConstMetric(poolImbalanceDesc, prometheus.GaugeValue, ratio, p.Name, metric)
+			}
+		}
+	}
+}
+
+// observeGets updates the get rate of a server since its last measurement.
+func (r *ringAnalyzer) observeGets(server, cmdGet string, now time.Time) {
+	gets, err := strconv.ParseFloat(cmdGet, 64)
+	if err != nil {
+		return
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	last, ok := r.last[server]
+	r.last[server] = ringLoad{gets: gets, time: now}
+	// Restarts reset the counter.
+	if !ok || gets < last.gets || !now.After(last.time) {
+		delete(r.rates, server)
+		return
+	}
+	r.rates[server] = (gets - last.gets) / now.Sub(last.time).Seconds()
+}
+
+// imbalance returns the highest ratio of a server's share of the load to its
+// keyspace share. A perfectly balanced pool has a ratio of 1.
+func imbalance(load, shares map[string]float64) (float64, bool) {
+	total := 0.
+	for _, v := range load {
+		total += v
+	}
+	if total == 0 {
+		return 0, false
+	}
+	ratio := 0.
+	for server, v := range load {
+		if shares[server] > 0 {
+			ratio = math.Max(ratio, v/total/shares[server])
+		}
+	}
+	return ratio, true
+}
@@ -0,0 +1,120 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"math"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestKeyspaceShares(t *testing.T) {
+	servers := []string{"a:11211", "b:11211", "c:11211"}
+	weights := map[string]int{"c:11211": 2}
+	for _, hash := range []string{hashModulo, hashKetama, hashJump} {
+		s, err := newSelector(hash, servers, weights)
+		if err != nil {
+			t.Fatal(err)
+		}
+		shares, err := keyspaceShares(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Ketama rings with few points per server are less even.
+		for server, want := range map[string]float64{"a:11211": .25, "b:11211": .25, "c:11211": .5} {
+			if math.Abs(shares[server]-want) > .05 {
+				t.Errorf("%s: want share %f of %s, have %f", hash, want, server, shares[server])
+			}
+		}
+	}
+
+	if _, err := newSelector("maglev", servers, nil); err == nil {
+		t.Error("want error for unknown hash algorithm")
+	}
+}
+
+// TestKetamaContinuum compares the continuum with the points and servers of
+// libketama's ketama_create_continuum and ketama_get_server for a weighted
+// server list, as computed by a separate port of them.
+func TestKetamaContinuum(t *testing.T) {
+	servers := []string{"10.0.1.1:11211", "10.0.1.2:11211", "10.0.1.3:11211"}
+	k := newKetamaSelector(servers, map[string]int{servers[0]: 600, servers[1]: 300, servers[2]: 100})
+
+	points := map[net.Addr]int{}
+	for _, p := range k.points {
+		points[k.addrs[p]]++
+	}
+	// 72, 36 and 12 digests of four points each.
+	for i, want := range []int{288, 144, 48} {
+		if have := points[serverAddr(servers[i])]; have != want {
+			t.Errorf("want %d points of %s, have %d", want, servers[i], have)
+		}
+	}
+	if first, last := k.points[0], k.points[len(k.points)-1]; first != 4826654 || last != 4284233799 {
+		t.Errorf("want points from 4826654 to 4284233799, have %d to %d", first, last)
+	}
+
+	for key, want := range map[string]string{
+		"foo":       servers[1],
+		"bar":       servers[0],
+		"memcached": servers[1],
+		"key:2":     servers[1],
+		"key:3":     servers[0],
+		"key:11":    servers[2],
+	} {
+		if have, _ := k.PickServer(key); have.String() != want {
+			t.Errorf("want server %s for key %q, have %s", want, key, have)
+		}
+	}
+}
+
+func TestRingAnalyzer(t *testing.T) {
+	a := fakeServer(t, map[string]string{"stats": "STAT curr_items 100\r\nSTAT bytes 1000\r\nSTAT cmd_get 10\r\nEND\r\n"})
+	b := fakeServer(t, map[string]string{"stats": "STAT curr_items 300\r\nSTAT bytes 1000\r\nSTAT cmd_get 10\r\nEND\r\n"})
+	pool := &Pool{Name: "cache", Servers: []string{a, b}, Hash: hashJump}
+	if err := pool.init(); err != nil {
+		t.Fatal(err)
+	}
+	r := newRingAnalyzer([]*Pool{pool}, time.Second)
+	// Make the shares exact for the test.
+	r.shares["cache"] = &ringShares{servers: a + "," + b, shares: map[string]float64{a: .5, b: .5}}
+
+	// The get rates are measured between two background measurements.
+	now := time.Now()
+	r.observeGets(a, "10", now)
+	r.observeGets(b, "10", now)
+	r.observeGets(a, "70", now.Add(time.Minute))
+	r.observeGets(b, "190", now.Add(time.Minute))
+
+	ch := make(chan prometheus.Metric, 10)
+	r.Collect(ch)
+	close(ch)
+	have := map[string]float64{}
+	for m := range ch {
+		k, v := metricKey(t, m)
+		have[k] = v
+	}
+	for k, want := range map[string]float64{
+		"cache,items": 1.5,
+		"bytes,cache": 1,
+		"cache,gets":  1.5,
+	} {
+		if v := have[poolImbalanceDesc.String()+k]; v != want {
+			t.Errorf("want %s imbalance %f, have %f", k, want, v)
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	// itemHeaderSize is the size of the item header on 64 bit platforms, which
+	// memcached adds to the -n minimum chunk size for the smallest class.
+	itemHeaderSize = 48
+	// maxSlabClasses is the maximum number of slab classes memcached supports.
+	maxSlabClasses = 63
+)
+
+var slabLayoutWasteDesc = newDesc(subsystemSlab, "layout_waste_bytes", "Estimated number of bytes wasted by the slab class layout for the observed item sizes.", "layout")
+
+// sizeBucket is a line of `stats sizes`: count items of up to size bytes.
+type sizeBucket struct {
+	size  float64
+	count float64
+}
+
+// parseSizes parses the output of `stats sizes` into buckets ordered by size.
+func parseSizes(stats map[string]string) ([]sizeBucket, error) {
+	if status, ok := stats["sizes_status"]; ok && status != "enabled" {
+		return nil, fmt.Errorf("item size tracking is %s", status)
+	}
+	var buckets []sizeBucket
+	for k, v := range stats {
+		size, err := strconv.ParseFloat(k, 64)
+		if err != nil {
+			continue
+		}
+		count, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid item count %q for size %s", v, k)
+		}
+		buckets = append(buckets, sizeBucket{size: size, count: count})
+	}
+	sort.Slice(buckets, func(i, j int) bool { return buckets[i].size < buckets[j].size })
+	return buckets, nil
+}
+
+// layoutWaste returns the bytes wasted by storing the items in the smallest
+// fitting chunk of the sorted layout. Items larger than the largest chunk are
+// ignored.
+func layoutWaste(layout []float64, sizes []sizeBucket) float64 {
+	waste := 0.
+	for _, b := range sizes {
+		i := sort.SearchFloat64s(layout, b.size)
+		if i == len(layout) {
+			continue
+		}
+		waste += (layout[i] - b.size) * b.count
+	}
+	return waste
+}
+
+// generateLayout returns the chunk sizes memcached creates for the given -n
+// and -f values, with maxChunk as the largest class. It returns nil if the
+// layout has too many classes.
+func generateLayout(minChunk int, factor, maxChunk float64) []float64 {
+	var layout []float64
+	size := float64(itemHeaderSize + minChunk)
+	for size <= maxChunk/factor {
+		// Chunks are aligned to 8 bytes.
+		size = math.Ceil(size/8) * 8
+		layout = append(layout, size)
+		size *= factor
+	}
+	layout = append(layout, maxChunk)
+	if len(layout) > maxSlabClasses {
+		return nil
+	}
+	return layout
+}
+
+// slabRecommendation is the result of a layout simulation.
+type slabRecommendation struct {
+	Factor           float64
+	MinChunkSize     int
+	CurrentWaste     float64
+	RecommendedWaste float64
+	Time             time.Time
+}
+
+// recommendLayout simulates the layouts for a range of -f and -n values and
+// returns the one wasting the least memory for the observed item sizes. If no
+// layout is better than the current one, the current waste is recommended.
+func recommendLayout(current []float64, sizes []sizeBucket) slabRecommendation {
+	sort.Float64s(current)
+	rec := slabRecommendation{
+		CurrentWaste:     layoutWaste(current, sizes),
+		RecommendedWaste: math.Inf(1),
+		Time:             time.Now(),
+	}
+	if len(current) == 0 {
+		return rec
+	}
+	maxChunk := current[len(current)-1]
+
+	for f := 105; f <= 200; f++ {
+		factor := float64(f) / 100
+		for n := 8; n <= 256; n += 8 {
+			layout := generateLayout(n, factor, maxChunk)
+			if layout == nil {
+				continue
+			}
+			if w := layoutWaste(layout, sizes); w < rec.RecommendedWaste {
+				rec.Factor, rec.MinChunkSize, rec.RecommendedWaste = factor, n, w
+			}
+		}
+	}
+	if rec.RecommendedWaste >= rec.CurrentWaste {
+		rec.Factor, rec.MinChunkSize, rec.RecommendedWaste = 0, 0, rec.CurrentWaste
+	}
+	return rec
+}
+
+// slabRecommender periodically simulates the slab class layouts for the item
+// sizes of a server and keeps the latest recommendation for scrapes and the
+// debug page.
+type slabRecommender struct {
+	address  string
+	timeout  time.Duration
+	interval time.Duration
+	dialer   *Dialer
+
+	mu   sync.Mutex
+	last *slabRecommendation
+}
+
+func newSlabRecommender(address string, timeout, interval time.Duration, dialer *Dialer) *slabRecommender {
+	return &slabRecommender{address: address, timeout: timeout, interval: interval, dialer: dialer}
+}
+
+// run updates the recommendation until the program exits. It never returns.
+func (r *slabRecommender) run() {
+	for {
+		if err := r.update(); err != nil {
+			log.Errorf("Failed to simulate slab layouts of %s: %s", r.address, err)
+		}
+		time.Sleep(r.interval)
+	}
+}
+
+// update runs `stats slabs` and `stats sizes` against the server and replaces
+// the recommendation on success.
+func (r *slabRecommender) update() error {
+	slabs, err := r.dialer.stats(r.address, r.timeout, "slabs")
+	if err != nil {
+		return err
+	}
+	stats, err := r.dialer.stats(r.address, r.timeout, "sizes")
+	if err != nil {
+		return err
+	}
+	sizes, err := parseSizes(stats)
+	if err != nil {
+		return err
+	}
+	var current []float64
+	for k, v := range slabs {
+		if !strings.HasSuffix(k, ":chunk_size") {
+			continue
+		}
+		if size, err := strconv.ParseFloat(v, 64); err == nil {
+			current = append(current, size)
+		}
+	}
+
+	rec := recommendLayout(current, sizes)
+	r.mu.Lock()
+	r.last = &rec
+	r.mu.Unlock()
+	return nil
+}
+
+// collect exports the waste of the current and the recommended layout of the
+// latest recommendation.
+func (r *slabRecommender) collect(ch chan<- prometheus.Metric) {
+	r.mu.Lock()
+	rec := r.last
+	r.mu.Unlock()
+	if rec == nil {
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(slabLayoutWasteDesc, prometheus.GaugeValue, rec.CurrentWaste, "current")
+	ch <- prometheus.MustNewConstMetric(slabLayoutWasteDesc, prometheus.GaugeValue, rec.RecommendedWaste, "recommended")
+}
+
+// ServeHTTP lists the latest recommendation.
+func (r *slabRecommender) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	rec := r.last
+	r.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if rec == nil {
+		fmt.Fprintln(w, "No recommendation yet, wait for the next simulation.")
+		return
+	}
+	fmt.Fprintf(w, "Computed at:               %s\n", rec.Time.Format(time.RFC3339))
+	fmt.Fprintf(w, "Current waste (bytes):     %.0f\n", rec.CurrentWaste)
+	if rec.Factor == 0 {
+		fmt.Fprintln(w, "The current layout is the best one found.")
+		return
+	}
+	fmt.Fprintf(w, "Recommended waste (bytes): %.0f\n", rec.RecommendedWaste)
+	fmt.Fprintf(w, "Recommended growth factor: -f %.2f\n", rec.Factor)
+	fmt.Fprintf(w, "Recommended min chunk:     -n %d\n", rec.MinChunkSize)
+}
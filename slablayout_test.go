@@ -0,0 +1,108 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestGenerateLayout(t *testing.T) {
+	// Chunk sizes of memcached started with the default -f 1.25 -n 48.
+	want := []float64{96, 120, 152, 192, 240, 304, 384, 480, 600, 752, 944, 1184, 1480}
+	have := generateLayout(48, 1.25, 1480)
+	if len(have) != len(want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	for i := range want {
+		if have[i] != want[i] {
+			t.Fatalf("want %v, have %v", want, have)
+		}
+	}
+
+	if l := generateLayout(8, 1.01, 1024*1024); l != nil {
+		t.Errorf("want nil for a layout with too many classes, have %d classes", len(l))
+	}
+}
+
+func TestRecommendLayout(t *testing.T) {
+	sizes, err := parseSizes(map[string]string{
+		"sizes_status": "enabled",
+		"160":          "1000",
+		"320":          "1000",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	current := generateLayout(48, 1.25, 1480)
+	rec := recommendLayout(current, sizes)
+	// 160 byte items use 192 byte chunks, 320 byte items 384 byte chunks.
+	if want := float64(32*1000 + 64*1000); rec.CurrentWaste != want {
+		t.Errorf("want current waste %v, have %v", want, rec.CurrentWaste)
+	}
+	if rec.Factor == 0 || rec.RecommendedWaste >= rec.CurrentWaste {
+		t.Errorf("want a better layout, have %+v", rec)
+	}
+	if w := layoutWaste(generateLayout(rec.MinChunkSize, rec.Factor, 1480), sizes); w != rec.RecommendedWaste {
+		t.Errorf("want recommended layout to waste %v, have %v", rec.RecommendedWaste, w)
+	}
+
+	if _, err := parseSizes(map[string]string{"sizes_status": "disabled"}); err == nil {
+		t.Error("want error for disabled size tracking")
+	}
+}
+
+func TestSlabRecommenderUpdate(t *testing.T) {
+	addr := fakeServer(t, map[string]string{
+		"stats slabs": "STAT 1:chunk_size 192\r\nSTAT 1:chunks_per_page 5461\r\nSTAT 2:chunk_size 384\r\nSTAT active_slabs 2\r\nEND\r\n",
+		"stats sizes": "STAT sizes_status enabled\r\nSTAT 160 1000\r\nSTAT 320 1000\r\nEND\r\n",
+	})
+	r := newSlabRecommender(addr, time.Second, time.Minute, nil)
+
+	// Nothing is exported before the first simulation.
+	ch := make(chan prometheus.Metric, 2)
+	r.collect(ch)
+	if len(ch) != 0 {
+		t.Fatalf("want no metrics before the first update, have %d", len(ch))
+	}
+
+	if err := r.update(); err != nil {
+		t.Fatal(err)
+	}
+	r.collect(ch)
+	close(ch)
+	have := map[string]float64{}
+	for m := range ch {
+		k, v := metricKey(t, m)
+		have[k] = v
+	}
+	current, _ := metricKey(t, prometheus.MustNewConstMetric(slabLayoutWasteDesc, prometheus.GaugeValue, 0, "current"))
+	recommended, _ := metricKey(t, prometheus.MustNewConstMetric(slabLayoutWasteDesc, prometheus.GaugeValue, 0, "recommended"))
+	// The current layout comes from the chunk sizes of `stats slabs`.
+	want := map[string]float64{
+		current:     32*1000 + 64*1000,
+		recommended: r.last.RecommendedWaste,
+	}
+	if len(have) != len(want) {
+		t.Fatalf("want %v, have %v", want, have)
+	}
+	for k, v := range want {
+		if have[k] != v {
+			t.Errorf("want %s = %v, have %v", k, v, have[k])
+		}
+	}
+}
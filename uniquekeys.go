@@ -0,0 +1,261 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"hash/fnv"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// hllPrecision is the number of index bits of a HyperLogLog sketch. 2^12
+	// registers have a standard error of about 1.6%.
+	hllPrecision = 12
+	// hllSlots is the number of sketches a rolling window is made of. The
+	// estimate covers between (hllSlots-1)/hllSlots of the window and the
+	// whole window.
+	hllSlots = 10
+)
+
+var (
+	uniqueKeysDesc       = newDesc("", "unique_keys_estimate", "Estimated number of distinct keys accessed in the rolling window.", "op", "window")
+	prefixUniqueKeysDesc = newDesc("", "prefix_unique_keys_estimate", "Estimated number of distinct keys with this prefix accessed in the rolling window.", "op", "window", "prefix")
+)
+
+// hyperLogLog is a HyperLogLog sketch of 2^hllPrecision registers.
+type hyperLogLog []uint8
+
+func newHyperLogLog() hyperLogLog {
+	return make(hyperLogLog, 1<<hllPrecision)
+}
+
+// hashKey returns a well mixed 64 bit hash of a key.
+func hashKey(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	// FNV alone doesn't spread short keys over the high bits, so the result
+	// is passed through the finalizer of MurmurHash3.
+	x := h.Sum64()
+	x ^= x >> 33
+	x *= 0xff51afd7ed558ccd
+	x ^= x >> 33
+	x *= 0xc4ceb9fe1a85ec53
+	x ^= x >> 33
+	return x
+}
+
+func (h hyperLogLog) add(x uint64) {
+	i := x >> (64 - hllPrecision)
+	// The rank is the position of the first set bit of the remaining bits.
+	rank := uint8(1)
+	for w := x << hllPrecision; w&(1<<63) == 0 && rank <= 64-hllPrecision; w <<= 1 {
+		rank++
+	}
+	if rank > h[i] {
+		h[i] = rank
+	}
+}
+
+func (h hyperLogLog) merge(o hyperLogLog) {
+	for i, r := range o {
+		if r > h[i] {
+			h[i] = r
+		}
+	}
+}
+
+func (h hyperLogLog) reset() {
+	for i := range h {
+		h[i] = 0
+	}
+}
+
+func (h hyperLogLog) estimate() float64 {
+	m := float64(len(h))
+	sum, zeros := 0., 0.
+	for _, r := range h {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Linear counting is more accurate for small cardinalities.
+		return m * math.Log(m/zeros)
+	}
+	return e
+}
+
+// rollingHLL estimates the distinct keys of a rolling window with a ring of
+// sketches, each covering a slot of the window.
+type rollingHLL struct {
+	slot  time.Duration
+	slots []hyperLogLog
+	cur   int
+	start time.Time
+}
+
+func newRollingHLL(window time.Duration, now time.Time) *rollingHLL {
+	r := &rollingHLL{slot: window / hllSlots, slots: make([]hyperLogLog, hllSlots), start: now}
+	for i := range r.slots {
+		r.slots[i] = newHyperLogLog()
+	}
+	return r
+}
+
+// advance moves the current slot forward to now, clearing expired slots.
+func (r *rollingHLL) advance(now time.Time) {
+	n := int(now.Sub(r.start) / r.slot)
+	if n <= 0 {
+		return
+	}
+	if n > len(r.slots) {
+		n = len(r.slots)
+	}
+	for i := 0; i < n; i++ {
+		r.cur = (r.cur + 1) % len(r.slots)
+		r.slots[r.cur].reset()
+	}
+	r.start = r.start.Add(time.Duration(now.Sub(r.start)/r.slot) * r.slot)
+}
+
+func (r *rollingHLL) add(x uint64, now time.Time) {
+	r.advance(now)
+	r.slots[r.cur].add(x)
+}
+
+func (r *rollingHLL) estimate(now time.Time) float64 {
+	r.advance(now)
+	h := newHyperLogLog()
+	for _, s := range r.slots {
+		h.merge(s)
+	}
+	return h.estimate()
+}
+
+// UniqueKeysOpts configures the unique keys aggregator.
+type UniqueKeysOpts struct {
+	// Windows are the durations of the rolling windows.
+	Windows []time.Duration
+	// Prefix additionally estimates the distinct keys per prefix if set.
+	Prefix *prefixRule
+	// MaxPrefixes caps the number of tracked prefixes, further prefixes are
+	// aggregated as _other.
+	MaxPrefixes int
+}
+
+// uniqueKeysSeries identifies the sketches of an operation and a prefix. The
+// sketches of all keys have no prefix.
+type uniqueKeysSeries struct {
+	op, prefix string
+	all        bool
+}
+
+// uniqueKeysAggregator estimates the number of distinct keys fetched and
+// written from the `watch fetchers mutations` streams with HyperLogLog.
+type uniqueKeysAggregator struct {
+	opts UniqueKeysOpts
+	now  func() time.Time
+
+	mu       sync.Mutex
+	series   map[uniqueKeysSeries][]*rollingHLL
+	prefixes map[string]bool
+}
+
+func newUniqueKeysAggregator(opts UniqueKeysOpts) *uniqueKeysAggregator {
+	return &uniqueKeysAggregator{
+		opts:     opts,
+		now:      time.Now,
+		series:   map[uniqueKeysSeries][]*rollingHLL{},
+		prefixes: map[string]bool{},
+	}
+}
+
+func (a *uniqueKeysAggregator) streams() []string {
+	return []string{"fetchers", "mutations"}
+}
+
+func (a *uniqueKeysAggregator) observe(ev watchEvent) {
+	var op string
+	switch ev.kind {
+	case "item_get":
+		op = "fetch"
+	case "item_store":
+		op = "write"
+	default:
+		return
+	}
+	key := ev.key()
+	x := hashKey(key)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := a.now()
+	a.add(uniqueKeysSeries{op: op, all: true}, x, now)
+	if a.opts.Prefix != nil {
+		p := a.opts.Prefix.prefix(key)
+		if !a.prefixes[p] {
+			if a.opts.MaxPrefixes > 0 && len(a.prefixes) >= a.opts.MaxPrefixes {
+				p = otherPrefix
+			}
+			a.prefixes[p] = true
+		}
+		a.add(uniqueKeysSeries{op: op, prefix: p}, x, now)
+	}
+}
+
+func (a *uniqueKeysAggregator) add(s uniqueKeysSeries, x uint64, now time.Time) {
+	hlls, ok := a.series[s]
+	if !ok {
+		for _, w := range a.opts.Windows {
+			hlls = append(hlls, newRollingHLL(w, now))
+		}
+		a.series[s] = hlls
+	}
+	for _, h := range hlls {
+		h.add(x, now)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (a *uniqueKeysAggregator) Describe(ch chan<- *prometheus.Desc) {
+	ch <- uniqueKeysDesc
+	if a.opts.Prefix != nil {
+		ch <- prefixUniqueKeysDesc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (a *uniqueKeysAggregator) Collect(ch chan<- prometheus.Metric) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := a.now()
+	for s, hlls := range a.series {
+		for i, h := range hlls {
+			window := model.Duration(a.opts.Windows[i]).String()
+			if s.all {
+				ch <- prometheus.MustNewConstMetric(uniqueKeysDesc, prometheus.GaugeValue, h.estimate(now), s.op, window)
+			} else {
+				ch <- prometheus.MustNewConstMetric(prefixUniqueKeysDesc, prometheus.GaugeValue, h.estimate(now), s.op, window, s.prefix)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHyperLogLog(t *testing.T) {
+	for _, n := range []int{10, 1000, 100000} {
+		h := newHyperLogLog()
+		for i := 0; i < n; i++ {
+			// Every key is added twice.
+			h.add(hashKey(fmt.Sprintf("key:%d", i)))
+			h.add(hashKey(fmt.Sprintf("key:%d", i)))
+		}
+		if e := h.estimate(); math.Abs(e-float64(n)) > 0.05*float64(n) {
+			t.Errorf("want about %d distinct keys, have %f", n, e)
+		}
+	}
+}
+
+func TestUniqueKeysAggregator(t *testing.T) {
+	now := time.Unix(1560000000, 0)
+	a := newUniqueKeysAggregator(UniqueKeysOpts{
+		Windows:     []time.Duration{time.Minute, time.Hour},
+		Prefix:      &prefixRule{delimiter: ":"},
+		MaxPrefixes: 2,
+	})
+	a.now = func() time.Time { return now }
+
+	event := func(kind, key string) watchEvent {
+		return watchEvent{kind: kind, fields: map[string]string{"key": key}}
+	}
+	for i := 0; i < 100; i++ {
+		a.observe(event("item_get", fmt.Sprintf("user:%d", i%50)))
+		a.observe(event("item_store", fmt.Sprintf("session:%d", i)))
+	}
+	now = now.Add(30 * time.Minute)
+	for i := 0; i < 20; i++ {
+		a.observe(event("item_get", fmt.Sprintf("feed:%d", i)))
+	}
+
+	ch := make(chan prometheus.Metric, 20)
+	a.Collect(ch)
+	close(ch)
+	have := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		key := ""
+		for _, l := range pb.GetLabel() {
+			key += l.GetName() + "=" + l.GetValue() + ","
+		}
+		have[key] = math.Round(pb.GetGauge().GetValue())
+	}
+	want := map[string]float64{
+		"op=fetch,window=1m,":                20,
+		"op=fetch,window=1h,":                70,
+		"op=write,window=1m,":                0,
+		"op=write,window=1h,":                100,
+		"op=fetch,prefix=user,window=1m,":    0,
+		"op=fetch,prefix=user,window=1h,":    50,
+		"op=write,prefix=session,window=1m,": 0,
+		"op=write,prefix=session,window=1h,": 100,
+		"op=fetch,prefix=_other,window=1m,":  20,
+		"op=fetch,prefix=_other,window=1h,":  20,
+	}
+	for k, v := range want {
+		if math.Abs(have[k]-v) > 0.05*v {
+			t.Errorf("%s: want about %f, have %f", k, v, have[k])
+		}
+	}
+	if len(have) != len(want) {
+		t.Errorf("want %d series, have %v", len(want), have)
+	}
+}
@@ -0,0 +1,252 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/log"
+)
+
+const (
+	subsystemWatcher = "watcher"
+
+	watchMinBackoff = time.Second
+	watchMaxBackoff = time.Minute
+)
+
+// watchEvent is a log line of the `watch` command, e.g.
+// "ts=1560000000.123456 gid=2 type=item_get key=foo status=found clsid=1 cfd=20 size=3".
+type watchEvent struct {
+	time   time.Time
+	kind   string
+	fields map[string]string
+}
+
+// key returns the unescaped key of the event.
+func (ev watchEvent) key() string {
+	k, err := url.QueryUnescape(ev.fields["key"])
+	if err != nil {
+		return ev.fields["key"]
+	}
+	return k
+}
+
+// int returns the integer value of a field, or false if it is missing.
+func (ev watchEvent) int(field string) (int64, bool) {
+	v, err := strconv.ParseInt(ev.fields[field], 10, 64)
+	return v, err == nil
+}
+
+// parseWatchLine parses a log line of the `watch` command.
+func parseWatchLine(line string) (watchEvent, error) {
+	ev := watchEvent{fields: map[string]string{}}
+	for _, field := range strings.Fields(line) {
+		kv := strings.SplitN(field, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		ev.fields[kv[0]] = kv[1]
+	}
+	ev.kind = ev.fields["type"]
+	if ts, err := strconv.ParseFloat(ev.fields["ts"], 64); err == nil {
+		ev.time = time.Unix(0, int64(ts*1e9))
+	} else {
+		ev.time = time.Now()
+	}
+	if ev.kind == "" {
+		return ev, fmt.Errorf("unexpected watch line %q", line)
+	}
+	return ev, nil
+}
+
+// watchAggregator consumes the events of a watch stream. The aggregated
+// results are exported on scrape through prometheus.Collector.
+type watchAggregator interface {
+	prometheus.Collector
+	// streams returns the watch arguments providing the events needed by the
+	// aggregator, e.g. "fetchers" or "evictions".
+	streams() []string
+	// observe is called for every event. It must not block.
+	observe(watchEvent)
+}
+
+// watcher keeps a `watch` connection to a memcached server open and feeds the
+// events into the aggregators. It reconnects with exponential backoff.
+type watcher struct {
+	address     string
+	timeout     time.Duration
+	streams     []string
+	aggregators []watchAggregator
+
+	connected  prometheus.Gauge
+	reconnects prometheus.Counter
+	events     *prometheus.CounterVec
+	skipped    prometheus.Counter
+}
+
+// newWatcher returns a watcher for the union of the given streams and the
+// streams needed by the aggregators.
+func newWatcher(address string, timeout time.Duration, streams []string, aggregators []watchAggregator) *watcher {
+	set := map[string]bool{}
+	for _, s := range streams {
+		set[s] = true
+	}
+	for _, a := range aggregators {
+		for _, s := range a.streams() {
+			set[s] = true
+		}
+	}
+	var all []string
+	for s := range set {
+		all = append(all, s)
+	}
+	sort.Strings(all)
+
+	return &watcher{
+		address:     address,
+		timeout:     timeout,
+		streams:     all,
+		aggregators: aggregators,
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Subsystem: subsystemWatcher,
+			Name:      "connected",
+			Help:      "Whether the watch connection to the server is established.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystemWatcher,
+			Name:      "reconnects_total",
+			Help:      "Number of times the watch connection was re-established.",
+		}),
+		events: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystemWatcher,
+			Name:      "events_total",
+			Help:      "Number of watch events received by type.",
+		}, []string{"type"}),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Subsystem: subsystemWatcher,
+			Name:      "skipped_events_total",
+			Help:      "Number of watch events the server skipped because the watcher fell behind.",
+		}),
+	}
+}
+
+// run keeps the watch connection open. It never returns.
+func (w *watcher) run() {
+	backoff := watchMinBackoff
+	for {
+		start := time.Now()
+		err := w.watch()
+		w.connected.Set(0)
+		log.Errorf("Watch connection to %s failed: %s", w.address, err)
+
+		// Only back off further if the connection didn't last.
+		if time.Since(start) > watchMaxBackoff {
+			backoff = watchMinBackoff
+		}
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > watchMaxBackoff {
+			backoff = watchMaxBackoff
+		}
+		w.reconnects.Inc()
+	}
+}
+
+// watch opens a watch connection and feeds the events to the aggregators
+// until the connection fails.
+func (w *watcher) watch() error {
+	conn, err := dial(w.address, w.timeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	conn.SetDeadline(time.Now().Add(w.timeout))
+	if _, err := fmt.Fprintf(conn, "watch %s\r\n", strings.Join(w.streams, " ")); err != nil {
+		return err
+	}
+	r := bufio.NewReader(conn)
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if line = strings.TrimRight(line, "\r\n"); line != "OK" {
+		if err := protocolError(line); err != nil {
+			return err
+		}
+		return fmt.Errorf("unexpected watch response %q", line)
+	}
+	conn.SetDeadline(time.Time{})
+	w.connected.Set(1)
+
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		w.handle(strings.TrimRight(line, "\r\n"))
+	}
+}
+
+// handle parses a line of the watch stream and passes it to the aggregators.
+func (w *watcher) handle(line string) {
+	if strings.HasPrefix(line, "skipped=") {
+		if n, err := strconv.ParseFloat(strings.TrimPrefix(line, "skipped="), 64); err == nil {
+			w.skipped.Add(n)
+		}
+		return
+	}
+	ev, err := parseWatchLine(line)
+	if err != nil {
+		log.Debugf("Ignoring watch line: %s", err)
+		return
+	}
+	w.events.WithLabelValues(ev.kind).Inc()
+	for _, a := range w.aggregators {
+		a.observe(ev)
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (w *watcher) Describe(ch chan<- *prometheus.Desc) {
+	w.connected.Describe(ch)
+	w.reconnects.Describe(ch)
+	w.events.Describe(ch)
+	w.skipped.Describe(ch)
+	for _, a := range w.aggregators {
+		a.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (w *watcher) Collect(ch chan<- prometheus.Metric) {
+	w.connected.Collect(ch)
+	w.reconnects.Collect(ch)
+	w.events.Collect(ch)
+	w.skipped.Collect(ch)
+	for _, a := range w.aggregators {
+		a.Collect(ch)
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2019 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// recordingAggregator remembers all observed events.
+type recordingAggregator struct {
+	want   []string
+	events []watchEvent
+}
+
+func (a *recordingAggregator) Describe(chan<- *prometheus.Desc) {}
+func (a *recordingAggregator) Collect(chan<- prometheus.Metric) {}
+func (a *recordingAggregator) streams() []string                { return a.want }
+func (a *recordingAggregator) observe(ev watchEvent)            { a.events = append(a.events, ev) }
+
+// watchServer accepts a single connection, records the watch command and
+// streams the events before closing the connection.
+func watchServer(t *testing.T, events string) (string, <-chan string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmds := make(chan string, 1)
+	go func() {
+		defer l.Close()
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		line, _ := bufio.NewReader(conn).ReadString('\n')
+		cmds <- strings.TrimSpace(line)
+		io.WriteString(conn, "OK\r\n"+events)
+	}()
+	return l.Addr().String(), cmds
+}
+
+func TestWatcher(t *testing.T) {
+	addr, cmds := watchServer(t, ""+
+		"ts=1560000000.500000 gid=1 type=item_get key=user%3A1 status=found clsid=1 cfd=20 size=3\n"+
+		"ts=1560000001.000000 gid=2 type=item_store key=user%3A1 status=stored cmd=set ttl=60 clsid=1 cfd=20 size=3\n"+
+		"skipped=5\n"+
+		"ts=1560000002.000000 gid=3 type=item_get key=user%3A2 status=not_found clsid=0 cfd=20 size=0\n")
+
+	a := &recordingAggregator{want: []string{"mutations", "fetchers"}}
+	w := newWatcher(addr, time.Second, []string{"fetchers"}, []watchAggregator{a})
+
+	if err := w.watch(); err != io.EOF {
+		t.Fatalf("want EOF after the stream, have %v", err)
+	}
+	if cmd := <-cmds; cmd != "watch fetchers mutations" {
+		t.Errorf("want watch of the union of streams, have %q", cmd)
+	}
+
+	if len(a.events) != 3 {
+		t.Fatalf("want 3 events, have %d", len(a.events))
+	}
+	ev := a.events[0]
+	if ev.kind != "item_get" || ev.key() != "user:1" || ev.fields["status"] != "found" {
+		t.Errorf("unexpected event %+v", ev)
+	}
+	if ev.time != time.Unix(1560000000, 5e8) {
+		t.Errorf("want event time 1560000000.5, have %v", ev.time)
+	}
+	if ttl, ok := a.events[1].int("ttl"); !ok || ttl != 60 {
+		t.Errorf("want ttl 60, have %v", ttl)
+	}
+
+	if v := counterValue(t, w.events.WithLabelValues("item_get")); v != 2 {
+		t.Errorf("want 2 item_get events, have %v", v)
+	}
+	if v := counterValue(t, w.skipped); v != 5 {
+		t.Errorf("want 5 skipped events, have %v", v)
+	}
+}